@@ -12,6 +12,15 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		// Drop the subcommand so the flags after it are parsed as usual
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		if err := reconcile(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var err error
 	app, err := server.SetupApplication()
 	if err != nil {
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/wisp167/Shop/internal/server"
+)
+
+// reconcile runs the reconcile subcommand: it reports the users whose balance
+// drifted and, with -fix, corrects them. It exits with status 1 when users are
+// left inconsistent so it can be run from a scheduled job.
+//
+//	avito-shop-service reconcile [-fix -reason=code -admin=username] [-timeout=5m] [database flags]
+func reconcile() error {
+	var opts server.ReconcileOptions
+	flag.BoolVar(&opts.Fix, "fix", false, "Set balances drifting from the ledger to the ledger balance")
+	flag.StringVar(&opts.Reason, "reason", "", "Reason code the corrections are recorded under")
+	flag.StringVar(&opts.Admin, "admin", os.Getenv("ADMIN_USERNAME"), "Admin the corrections are recorded under")
+
+	app, err := server.SetupReconcile()
+	if err != nil {
+		return err
+	}
+
+	unresolved, err := app.Reconcile(context.Background(), opts, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if unresolved > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrCartEmpty        = errors.New("cart is empty")
+	ErrCartLineTooLarge = errors.New("cart line quantity too large")
+)
+
+// CartLine is an item in a user's cart. AddedPrice is the price the item had
+// when it was first put in the cart, Price is the current catalog price.
+type CartLine struct {
+	Item         string `json:"item"`
+	Quantity     int    `json:"quantity"`
+	AddedPrice   int    `json:"addedPrice"`
+	Price        int    `json:"price"`
+	PriceChanged bool   `json:"priceChanged"`
+	Available    bool   `json:"available"`
+}
+
+type Cart struct {
+	Total int         `json:"total"`
+	Lines []*CartLine `json:"items"`
+}
+
+// PriceChange reports an item of a checked out cart whose price differs from
+// the price it had when it was added.
+type PriceChange struct {
+	Item       string `json:"item"`
+	AddedPrice int    `json:"addedPrice"`
+	Price      int    `json:"price"`
+}
+
+// getCartID returns the id of the user's cart, creating the cart on first use.
+func (q *Queries) getCartID(ctx context.Context, userID int64) (int64, error) {
+	stmt := `
+		INSERT INTO carts (user_id) VALUES ($1)
+		ON CONFLICT (user_id) DO UPDATE SET updated_at = now()
+		RETURNING id`
+
+	var cartID int64
+	err := q.db.QueryRowContext(ctx, stmt, userID).Scan(&cartID)
+	return cartID, err
+}
+
+// GetCart lists the user's cart priced at the current catalog prices.
+func (q *Queries) GetCart(ctx context.Context, userID int64) (*Cart, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := fmt.Sprintf(`
+		SELECT i.name, cl.quantity, cl.added_price, i.price, %s
+		FROM carts c
+		JOIN cart_lines cl ON cl.cart_id = c.id
+		JOIN items i ON i.id = cl.item_id
+		WHERE c.user_id = $1
+		ORDER BY cl.added_at, i.name`, availableExpr)
+
+	rows, err := q.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cart := &Cart{Lines: []*CartLine{}}
+	for rows.Next() {
+		var line CartLine
+		if err := rows.Scan(&line.Item, &line.Quantity, &line.AddedPrice, &line.Price, &line.Available); err != nil {
+			return nil, err
+		}
+		line.PriceChanged = line.Price != line.AddedPrice
+		cart.Total += line.Price * line.Quantity
+		cart.Lines = append(cart.Lines, &line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+// AddCartLine puts units of an item in the user's cart, adding to the quantity
+// already there. The price is remembered the first time the item is added.
+func (q *Queries) AddCartLine(ctx context.Context, userID int64, itemName string, quantity int) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	item, err := q.GetItemByName(ctx, itemName)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return &PurchaseError{Item: itemName, Err: ErrItemNotFound}
+	}
+	if item.Archived {
+		return &PurchaseError{Item: itemName, Err: ErrItemArchived}
+	}
+
+	cartID, err := q.getCartID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `
+		INSERT INTO cart_lines (cart_id, item_id, quantity, added_price) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (cart_id, item_id) DO UPDATE SET quantity = cart_lines.quantity + EXCLUDED.quantity`
+
+	_, err = q.db.ExecContext(ctx, stmt, cartID, item.ID, quantity, item.Price)
+	return cartLineError(err)
+}
+
+// SetCartLineQuantity replaces the quantity of an item already in the cart.
+func (q *Queries) SetCartLineQuantity(ctx context.Context, userID int64, itemName string, quantity int) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		UPDATE cart_lines cl SET quantity = $3
+		FROM carts c, items i
+		WHERE cl.cart_id = c.id AND cl.item_id = i.id AND c.user_id = $1 AND i.name = $2`
+
+	result, err := q.db.ExecContext(ctx, stmt, userID, itemName, quantity)
+	if err != nil {
+		return cartLineError(err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (q *Queries) RemoveCartLine(ctx context.Context, userID int64, itemName string) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		DELETE FROM cart_lines cl
+		USING carts c, items i
+		WHERE cl.cart_id = c.id AND cl.item_id = i.id AND c.user_id = $1 AND i.name = $2`
+
+	result, err := q.db.ExecContext(ctx, stmt, userID, itemName)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// CheckoutCart buys everything in the user's cart at the current prices and
+// empties it. Items whose price changed since they were added are reported
+// alongside the receipt.
+func (q *Queries) CheckoutCart(ctx context.Context, userID int64) (*Receipt, []PriceChange, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		SELECT i.name, cl.quantity, cl.added_price
+		FROM carts c
+		JOIN cart_lines cl ON cl.cart_id = c.id
+		JOIN items i ON i.id = cl.item_id
+		WHERE c.user_id = $1
+		FOR UPDATE OF c, cl`
+
+	rows, err := q.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var lines []PurchaseLine
+	addedPrices := make(map[string]int)
+	for rows.Next() {
+		var line PurchaseLine
+		var addedPrice int
+		if err := rows.Scan(&line.Item, &line.Quantity, &addedPrice); err != nil {
+			return nil, nil, err
+		}
+		lines = append(lines, line)
+		addedPrices[line.Item] = addedPrice
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil, ErrCartEmpty
+	}
+
+	receipt, err := q.Purchase(ctx, userID, lines)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := []PriceChange{}
+	for _, line := range receipt.Lines {
+		if added := addedPrices[line.Item]; added != line.UnitPrice {
+			changes = append(changes, PriceChange{Item: line.Item, AddedPrice: added, Price: line.UnitPrice})
+		}
+	}
+
+	stmt = `DELETE FROM cart_lines cl USING carts c WHERE cl.cart_id = c.id AND c.user_id = $1`
+	if _, err := q.db.ExecContext(ctx, stmt, userID); err != nil {
+		return nil, nil, err
+	}
+	return receipt, changes, nil
+}
+
+func cartLineError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "check_violation" {
+		return ErrCartLineTooLarge
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+const (
+	HistorySent     = "sent"
+	HistoryReceived = "received"
+	HistoryPurchase = "purchase"
+	HistoryRefund   = "refund"
+)
+
+var HistoryDirections = []string{HistorySent, HistoryReceived, HistoryPurchase, HistoryRefund}
+
+var ErrInvalidCursor = errors.New("invalid history cursor")
+
+// HistoryEntry is a movement of coins in the wallet of a user. Counterparty is
+// the other user of a transfer, empty for purchases, refunds and minted coins.
+// Item, Quantity and UnitPrice are only set for purchases and refunds.
+type HistoryEntry struct {
+	ID           string    `json:"id"`
+	Direction    string    `json:"direction"`
+	Counterparty string    `json:"counterparty,omitempty"`
+	Item         string    `json:"item,omitempty"`
+	Quantity     *int      `json:"quantity,omitempty"`
+	UnitPrice    *int      `json:"price,omitempty"`
+	Amount       int       `json:"amount"`
+	CreatedAt    time.Time `json:"createdAt"`
+
+	source int
+	seq    int64
+}
+
+// Sources of the history entries, the entries of a source are numbered by the
+// serial id of its table.
+const (
+	historyReceived = iota
+	historySent
+	historyOrderLines
+	historyRefunds
+)
+
+// HistoryCursor points after the last entry of a page. Entries are ordered by
+// creation time, newest first, and entries created at the same time by their
+// source and serial id, which only grow.
+type HistoryCursor struct {
+	CreatedAt time.Time
+	Source    int
+	Seq       int64
+}
+
+// Encode returns the cursor as an opaque string for clients.
+func (c HistoryCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%d|%d", c.CreatedAt.Format(time.RFC3339Nano), c.Source, c.Seq)))
+}
+
+// DecodeHistoryCursor parses a cursor returned by Encode.
+func DecodeHistoryCursor(s string) (*HistoryCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.Split(string(b), "|")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	source, err := strconv.Atoi(parts[1])
+	if err != nil || source < historyReceived || source > historyRefunds {
+		return nil, ErrInvalidCursor
+	}
+	seq, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || seq < 1 {
+		return nil, ErrInvalidCursor
+	}
+	return &HistoryCursor{CreatedAt: t, Source: source, Seq: seq}, nil
+}
+
+// HistoryFilter selects the history entries of a page, zero values do not filter.
+type HistoryFilter struct {
+	Direction    string
+	Counterparty string
+	MinAmount    *int
+	MaxAmount    *int
+	From         *time.Time
+	To           *time.Time
+	After        *HistoryCursor
+	Limit        int
+}
+
+func ValidateHistoryFilter(v *validator.Validator, f HistoryFilter) {
+	if f.Direction != "" {
+		v.Check(validator.PermittedValue(f.Direction, HistoryDirections...), "direction", "must be sent, received, purchase or refund")
+	}
+	if f.Counterparty != "" {
+		v.Check(f.Direction != HistoryPurchase && f.Direction != HistoryRefund, "counterparty", "cannot be combined with purchases or refunds")
+	}
+	if f.MinAmount != nil && f.MaxAmount != nil {
+		v.Check(*f.MinAmount <= *f.MaxAmount, "min_amount", "must not be greater than max_amount")
+	}
+	if f.From != nil && f.To != nil {
+		v.Check(f.From.Before(*f.To), "from", "must be before to")
+	}
+	v.Check(f.Limit > 0, "limit", "must be greater than zero")
+	v.Check(f.Limit <= 100, "limit", "must be a maximum of 100")
+}
+
+// GetHistory returns a page of the transfers, purchased items and refunds of
+// the user, newest first, and the cursor of the next page, nil on the last page.
+func (q *Queries) GetHistory(ctx context.Context, userID int64, f HistoryFilter) ([]*HistoryEntry, *HistoryCursor, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		SELECT h.id, h.direction, h.counterparty, h.item, h.quantity, h.unit_price, h.amount, h.created_at,
+			h.source, h.seq
+		FROM (
+			SELECT t.public_id AS id, 'received' AS direction, u.username AS counterparty,
+				NULL AS item, NULL::int AS quantity, NULL::int AS unit_price, t.amount, t.created_at,
+				0 AS source, t.id AS seq
+			FROM transactions t
+			LEFT JOIN users u ON u.id = t.from_user_id
+			WHERE t.to_user_id = $1
+			UNION ALL
+			SELECT t.public_id, 'sent', u.username, NULL, NULL, NULL, t.amount, t.created_at, 1, t.id
+			FROM transactions t
+			JOIN users u ON u.id = t.to_user_id
+			WHERE t.from_user_id = $1
+			UNION ALL
+			SELECT ol.public_id, 'purchase', NULL, i.name, ol.quantity, ol.unit_price, ol.quantity * ol.unit_price, o.created_at,
+				2, ol.id
+			FROM order_lines ol
+			JOIN orders o ON o.id = ol.order_id
+			JOIN items i ON i.id = ol.item_id
+			WHERE o.user_id = $1
+			UNION ALL
+			SELECT r.public_id, 'refund', NULL, i.name, r.quantity, ol.unit_price, r.amount, r.created_at, 3, r.id
+			FROM refunds r
+			JOIN order_lines ol ON ol.order_id = r.order_id AND ol.item_id = r.item_id
+			JOIN items i ON i.id = r.item_id
+			WHERE r.user_id = $1
+		) h
+		WHERE ($2 = '' OR h.direction = $2)
+		AND ($3 = '' OR h.counterparty = $3)
+		AND ($4::int IS NULL OR h.amount >= $4)
+		AND ($5::int IS NULL OR h.amount <= $5)
+		AND ($6::timestamptz IS NULL OR h.created_at >= $6)
+		AND ($7::timestamptz IS NULL OR h.created_at < $7)
+		AND ($8::timestamptz IS NULL OR (h.created_at, h.source, h.seq) < ($8, $9::int, $10::bigint))
+		ORDER BY h.created_at DESC, h.source DESC, h.seq DESC
+		LIMIT $11`
+
+	var (
+		afterTime   *time.Time
+		afterSource *int
+		afterSeq    *int64
+	)
+	if f.After != nil {
+		afterTime, afterSource, afterSeq = &f.After.CreatedAt, &f.After.Source, &f.After.Seq
+	}
+
+	// One more row tells whether there is a next page
+	rows, err := q.db.QueryContext(ctx, stmt, userID, f.Direction, f.Counterparty, f.MinAmount, f.MaxAmount,
+		f.From, f.To, afterTime, afterSource, afterSeq, f.Limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	entries := []*HistoryEntry{}
+	for rows.Next() {
+		var (
+			entry              HistoryEntry
+			counterparty, item sql.NullString
+		)
+		err := rows.Scan(&entry.ID, &entry.Direction, &counterparty, &item, &entry.Quantity, &entry.UnitPrice, &entry.Amount, &entry.CreatedAt,
+			&entry.source, &entry.seq)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.Counterparty = counterparty.String
+		entry.Item = item.String
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(entries) <= f.Limit {
+		return entries, nil, nil
+	}
+	entries = entries[:f.Limit]
+	last := entries[f.Limit-1]
+	return entries, &HistoryCursor{CreatedAt: last.CreatedAt, Source: last.source, Seq: last.seq}, nil
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrIdempotencyKeyInUse    = errors.New("idempotency key is being processed")
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key reused with a different request")
+)
+
+// IdempotentResponse is the response stored for an idempotency key.
+type IdempotentResponse struct {
+	Status int
+	Body   []byte
+}
+
+// ReserveIdempotencyKey claims a key of the user before the request runs. It
+// returns nil when the request should run, or the stored response when the key
+// was already used for the same request within the retention window. A key
+// whose request is still running returns ErrIdempotencyKeyInUse, a key used for
+// another request ErrIdempotencyKeyMismatch. The claim lasts for lease, a
+// request which did not settle the key by then is taken to have died and a
+// retry of it takes the key over.
+func (q *Queries) ReserveIdempotencyKey(ctx context.Context, userID int64, key string, fingerprint []byte, retention, lease time.Duration) (*IdempotentResponse, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	// Expired keys are taken over as if they were new
+	stmt := `
+		INSERT INTO idempotency_keys (user_id, key, fingerprint, locked_until)
+		VALUES ($1, $2, $3, now() + $5 * interval '1 microsecond')
+		ON CONFLICT (user_id, key) DO UPDATE SET
+			fingerprint = EXCLUDED.fingerprint, status = NULL, response = NULL,
+			locked_until = EXCLUDED.locked_until, created_at = now()
+		WHERE idempotency_keys.created_at < now() - $4 * interval '1 microsecond'
+			OR (idempotency_keys.status IS NULL
+				AND idempotency_keys.locked_until < now()
+				AND idempotency_keys.fingerprint = EXCLUDED.fingerprint)`
+
+	result, err := q.db.ExecContext(ctx, stmt, userID, key, fingerprint, retention.Microseconds(), lease.Microseconds())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows > 0 {
+		return nil, nil
+	}
+
+	stmt = `SELECT fingerprint, status, response FROM idempotency_keys WHERE user_id = $1 AND key = $2`
+
+	var (
+		stored   []byte
+		status   sql.NullInt64
+		response []byte
+	)
+	err = q.db.QueryRowContext(ctx, stmt, userID, key).Scan(&stored, &status, &response)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(stored, fingerprint) {
+		return nil, ErrIdempotencyKeyMismatch
+	}
+	if !status.Valid {
+		return nil, ErrIdempotencyKeyInUse
+	}
+	return &IdempotentResponse{Status: int(status.Int64), Body: response}, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request a key was reserved for.
+func (q *Queries) CompleteIdempotencyKey(ctx context.Context, userID int64, key string, response *IdempotentResponse) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `UPDATE idempotency_keys SET status = $3, response = $4, locked_until = NULL WHERE user_id = $1 AND key = $2`
+	_, err := q.db.ExecContext(ctx, stmt, userID, key, response.Status, response.Body)
+	return err
+}
+
+// ReleaseIdempotencyKey drops a reserved key so that the request can be retried
+// with it, used when the request failed without taking effect.
+func (q *Queries) ReleaseIdempotencyKey(ctx context.Context, userID int64, key string) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND status IS NULL`
+	_, err := q.db.ExecContext(ctx, stmt, userID, key)
+	return err
+}
+
+// DeleteExpiredIdempotencyKeys drops the keys older than the retention window.
+func (q *Queries) DeleteExpiredIdempotencyKeys(ctx context.Context, retention time.Duration) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `DELETE FROM idempotency_keys WHERE created_at < now() - $1 * interval '1 microsecond'`
+	_, err := q.db.ExecContext(ctx, stmt, retention.Microseconds())
+	return err
+}
@@ -0,0 +1,245 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+var (
+	ErrDuplicateItemName     = errors.New("duplicate item name")
+	ErrSoldOut               = errors.New("item is sold out")
+	ErrPurchaseLimitExceeded = errors.New("item purchase limit exceeded")
+	ErrUnlimitedStock        = errors.New("item stock is unlimited")
+)
+
+// availableExpr is the SQL condition under which an item can be bought.
+const availableExpr = `NOT archived AND (stock IS NULL OR stock > 0)`
+
+// CatalogItem is an item as it is listed in the catalog, unlike Item which
+// describes an entry of a user's inventory.
+// A nil Stock means the item is never sold out, a nil PurchaseLimit means a
+// user may own any number of units.
+type CatalogItem struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Price         int    `json:"price"`
+	Description   string `json:"description"`
+	Stock         *int   `json:"stock"`
+	PurchaseLimit *int   `json:"purchaseLimit"`
+	Archived      bool   `json:"archived"`
+	Available     bool   `json:"available"`
+}
+
+func ValidateCatalogItem(v *validator.Validator, item *CatalogItem) {
+	v.Check(item.Name != "", "name", "must be provided")
+	v.Check(utf8.RuneCountInString(item.Name) <= 255, "name", "must not be more than 255 characters long")
+	v.Check(validator.Matches(item.Name, validator.ItemNameRX), "name", "must contain only lowercase letters, digits, '_' or '-'")
+	v.Check(item.Price >= 0, "price", "must not be negative")
+	v.Check(utf8.RuneCountInString(item.Description) <= 1000, "description", "must not be more than 1000 characters long")
+	v.Check(item.Stock == nil || *item.Stock >= 0, "stock", "must not be negative")
+	v.Check(item.PurchaseLimit == nil || *item.PurchaseLimit > 0, "purchaseLimit", "must be greater than zero")
+}
+
+func (q *Queries) InsertItem(ctx context.Context, item *CatalogItem) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := fmt.Sprintf(`
+		INSERT INTO items (name, price, description, stock, purchase_limit) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, archived, %s`, availableExpr)
+
+	args := []any{item.Name, item.Price, item.Description, item.Stock, item.PurchaseLimit}
+	err := q.db.QueryRowContext(ctx, stmt, args...).Scan(&item.ID, &item.Archived, &item.Available)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+			return ErrDuplicateItemName
+		}
+		return err
+	}
+	return nil
+}
+
+func (q *Queries) GetCatalogItem(ctx context.Context, itemID int64) (*CatalogItem, error) {
+	return q.getCatalogItem(ctx, itemID, "")
+}
+
+// LockCatalogItem reads the item and locks it until the end of the
+// transaction, so that it can be changed without undoing concurrent changes.
+func (q *Queries) LockCatalogItem(ctx context.Context, itemID int64) (*CatalogItem, error) {
+	return q.getCatalogItem(ctx, itemID, "FOR UPDATE")
+}
+
+func (q *Queries) getCatalogItem(ctx context.Context, itemID int64, lock string) (*CatalogItem, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := fmt.Sprintf(`
+		SELECT id, name, price, description, stock, purchase_limit, archived, %s
+		FROM items WHERE id = $1 %s`, availableExpr, lock)
+
+	var item CatalogItem
+	err := q.db.QueryRowContext(ctx, stmt, itemID).Scan(&item.ID, &item.Name, &item.Price, &item.Description,
+		&item.Stock, &item.PurchaseLimit, &item.Archived, &item.Available)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return &item, nil
+}
+
+// UpdateItem saves the item, which must have been read with LockCatalogItem in
+// the same transaction. The stock level is only overwritten when setStock is
+// true, purchases lower it without locking the item.
+func (q *Queries) UpdateItem(ctx context.Context, item *CatalogItem, setStock bool) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := fmt.Sprintf(`
+		UPDATE items SET name = $1, price = $2, description = $3, purchase_limit = $4, archived = $5,
+			stock = CASE WHEN $6 THEN $7::int ELSE stock END
+		WHERE id = $8
+		RETURNING stock, %s`, availableExpr)
+
+	args := []any{item.Name, item.Price, item.Description, item.PurchaseLimit, item.Archived, setStock, item.Stock, item.ID}
+	err := q.db.QueryRowContext(ctx, stmt, args...).Scan(&item.Stock, &item.Available)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		case errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation":
+			return ErrDuplicateItemName
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// SetItemArchived takes an item off sale or puts it back and returns it.
+func (q *Queries) SetItemArchived(ctx context.Context, itemID int64, archived bool) (*CatalogItem, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := fmt.Sprintf(`
+		UPDATE items SET archived = $1 WHERE id = $2
+		RETURNING id, name, price, description, stock, purchase_limit, archived, %s`, availableExpr)
+
+	var item CatalogItem
+	err := q.db.QueryRowContext(ctx, stmt, archived, itemID).Scan(&item.ID, &item.Name, &item.Price, &item.Description,
+		&item.Stock, &item.PurchaseLimit, &item.Archived, &item.Available)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return &item, nil
+}
+
+// RestockItem adds units to the stock of a limited item.
+func (q *Queries) RestockItem(ctx context.Context, itemID int64, quantity int) (*CatalogItem, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `UPDATE items SET stock = stock + $1 WHERE id = $2 AND stock IS NOT NULL`
+
+	result, err := q.db.ExecContext(ctx, stmt, quantity, itemID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := q.GetCatalogItem(ctx, itemID)
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, ErrUnlimitedStock
+	}
+	return item, nil
+}
+
+// DecrementItemStock takes units of a limited item out of stock, it returns
+// ErrSoldOut when not enough units are left. Items with unlimited stock are
+// not touched.
+func (q *Queries) DecrementItemStock(ctx context.Context, itemID int64, quantity int) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `UPDATE items SET stock = stock - $1 WHERE id = $2 AND stock >= $1`
+
+	result, err := q.db.ExecContext(ctx, stmt, quantity, itemID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	var limited bool
+	err = q.db.QueryRowContext(ctx, `SELECT stock IS NOT NULL FROM items WHERE id = $1`, itemID).Scan(&limited)
+	if err != nil {
+		return err
+	}
+	if limited {
+		return ErrSoldOut
+	}
+	return nil
+}
+
+// GetAllItems lists the catalog. Nil price bounds and availability are not applied.
+func (q *Queries) GetAllItems(ctx context.Context, minPrice *int, maxPrice *int, available *bool, filters Filters) ([]*CatalogItem, Metadata, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, name, price, description, archived, %[1]s
+		FROM items
+		WHERE ($1::int IS NULL OR price >= $1)
+		AND ($2::int IS NULL OR price <= $2)
+		AND ($3::boolean IS NULL OR (%[1]s) = $3)
+		ORDER BY %[2]s %[3]s, id ASC
+		LIMIT $4 OFFSET $5`, availableExpr, filters.sortColumn(), filters.sortDirection())
+
+	rows, err := q.db.QueryContext(ctx, stmt, minPrice, maxPrice, available, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	items := []*CatalogItem{}
+
+	for rows.Next() {
+		var item CatalogItem
+		err := rows.Scan(&totalRecords, &item.ID, &item.Name, &item.Price, &item.Description, &item.Archived, &item.Available)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		items = append(items, &item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return items, metadata, nil
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+const (
+	LedgerOpening  = "opening"
+	LedgerTransfer = "transfer"
+	LedgerMint     = "mint"
+	LedgerPurchase = "purchase"
+	LedgerRefund   = "refund"
+)
+
+// Accounts of the ledger. Every user has a wallet account, coins spent on merch
+// go to the shop and coins given to users come out of the mint, whose balance
+// is therefore negative.
+const (
+	AccountUser = "user"
+	AccountShop = "shop"
+	AccountMint = "mint"
+)
+
+var ErrUnbalancedEntry = errors.New("ledger entry is not balanced")
+
+// Posting moves Amount coins into an account, a negative amount takes them
+// out. UserID is only set for user accounts.
+type Posting struct {
+	Account string
+	UserID  int64
+	Amount  int
+}
+
+func userPosting(userID int64, amount int) Posting {
+	return Posting{Account: AccountUser, UserID: userID, Amount: amount}
+}
+
+// postEntry appends an entry to the ledger. The postings must sum to zero,
+// postings of zero coins are left out. Reference is the public id of the
+// transfer or order the entry records, empty when there is none. postEntry
+// must run inside WithTx together with the balance updates it records.
+func (q *Queries) postEntry(ctx context.Context, kind string, reference string, postings ...Posting) error {
+	sum := 0
+	for _, p := range postings {
+		sum += p.Amount
+	}
+	if sum != 0 {
+		return ErrUnbalancedEntry
+	}
+
+	var ref sql.NullString
+	if reference != "" {
+		ref = sql.NullString{String: reference, Valid: true}
+	}
+
+	var entryID int64
+	stmt := `INSERT INTO ledger_entries (kind, reference) VALUES ($1, $2) RETURNING id`
+	if err := q.db.QueryRowContext(ctx, stmt, kind, ref).Scan(&entryID); err != nil {
+		return err
+	}
+
+	stmt = `INSERT INTO ledger_postings (entry_id, account, user_id, amount) VALUES ($1, $2, $3, $4)`
+	for _, p := range postings {
+		if p.Amount == 0 {
+			continue
+		}
+		var userID sql.NullInt64
+		if p.Account == AccountUser {
+			userID = sql.NullInt64{Int64: p.UserID, Valid: true}
+		}
+		if _, err := q.db.ExecContext(ctx, stmt, entryID, p.Account, userID, p.Amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BalanceCheck compares the balance stored on a user with the balance derived
+// from the ledger.
+type BalanceCheck struct {
+	Stored     int  `json:"stored"`
+	Ledger     int  `json:"ledger"`
+	Consistent bool `json:"consistent"`
+}
+
+// CheckBalance derives the balance of the user from the ledger and compares it
+// with the stored balance.
+func (q *Queries) CheckBalance(ctx context.Context, userID int64) (*BalanceCheck, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		SELECT u.balance, COALESCE(sum(p.amount), 0)
+		FROM users u
+		LEFT JOIN ledger_postings p ON p.account = 'user' AND p.user_id = u.id
+		WHERE u.id = $1
+		GROUP BY u.id`
+
+	var check BalanceCheck
+	err := q.db.QueryRowContext(ctx, stmt, userID).Scan(&check.Stored, &check.Ledger)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	check.Consistent = check.Stored == check.Ledger
+	return &check, nil
+}
@@ -0,0 +1,121 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginPolicy throttles failed logins. The first half of MaxFailures failures
+// are free, each following failure doubles the wait before the next attempt,
+// starting at Delay, and MaxFailures failures lock the login for Lockout. The
+// count starts over once Lockout has passed since the last failure.
+type LoginPolicy struct {
+	MaxFailures int
+	Delay       time.Duration
+	Lockout     time.Duration
+}
+
+// Wait returns how long logins are refused after the given number of failures.
+func (p LoginPolicy) Wait(failures int) time.Duration {
+	if failures >= p.MaxFailures {
+		return p.Lockout
+	}
+	free := p.MaxFailures / 2
+	if failures <= free {
+		return 0
+	}
+	wait := p.Delay << (failures - free - 1)
+	if wait <= 0 || wait > p.Lockout {
+		return p.Lockout
+	}
+	return wait
+}
+
+// LockedUntil returns when logins are accepted again.
+func (p LoginPolicy) LockedUntil(failures int, lastFailedAt time.Time) time.Time {
+	return lastFailedAt.Add(p.Wait(failures))
+}
+
+// MaxUsernameLength is the length of the username columns, a longer username
+// can neither be registered nor have its failed logins counted.
+const MaxUsernameLength = 255
+
+type LoginFailures struct {
+	Failures     int
+	LastFailedAt time.Time
+}
+
+// GetLoginFailures returns the failed logins of a username, nil when there are none.
+func (q *Queries) GetLoginFailures(ctx context.Context, username string) (*LoginFailures, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `SELECT failures, last_failed_at FROM login_failures WHERE username = $1`
+
+	var f LoginFailures
+	err := q.db.QueryRowContext(ctx, stmt, username).Scan(&f.Failures, &f.LastFailedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &f, nil
+}
+
+// RecordLoginFailure counts a failed login of a username. Failures older than
+// resetAfter are forgotten.
+func (q *Queries) RecordLoginFailure(ctx context.Context, username string, resetAfter time.Duration) (*LoginFailures, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		INSERT INTO login_failures (username, failures, last_failed_at)
+		VALUES ($1, 1, now())
+		ON CONFLICT (username) DO UPDATE SET
+			failures = CASE
+				WHEN login_failures.last_failed_at < now() - $2 * interval '1 microsecond' THEN 1
+				ELSE login_failures.failures + 1
+			END,
+			last_failed_at = now()
+		RETURNING failures, last_failed_at`
+
+	var f LoginFailures
+	err := q.db.QueryRowContext(ctx, stmt, username, resetAfter.Microseconds()).Scan(&f.Failures, &f.LastFailedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ClearLoginFailures forgets the failed logins of a username, it reports
+// whether there were any.
+func (q *Queries) ClearLoginFailures(ctx context.Context, username string) (bool, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `DELETE FROM login_failures WHERE username = $1`
+
+	result, err := q.db.ExecContext(ctx, stmt, username)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// DeleteStaleLoginFailures drops the failed logins older than resetAfter, they
+// no longer count.
+func (q *Queries) DeleteStaleLoginFailures(ctx context.Context, resetAfter time.Duration) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `DELETE FROM login_failures WHERE last_failed_at < now() - $1 * interval '1 microsecond'`
+	_, err := q.db.ExecContext(ctx, stmt, resetAfter.Microseconds())
+	return err
+}
@@ -1,20 +1,59 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 var (
-	ErrRecordNotFound = errors.New("record not found")
+	ErrRecordNotFound    = errors.New("record not found")
+	ErrDuplicateUsername = errors.New("duplicate username")
 )
 
+// DBTX is implemented by both *sql.DB and *sql.Tx, so queries can run against
+// the connection pool or inside a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type Models struct {
 	Shop ShopModel
 }
 
-func NewModels(db *sql.DB) Models {
+// Config tunes how the models talk to the database.
+type Config struct {
+	// QueryTimeout bounds every query.
+	QueryTimeout time.Duration
+	// TxIsolation is the isolation level of transactions started by WithTx.
+	TxIsolation sql.IsolationLevel
+	// TxMaxAttempts is how many times a transaction is run before a
+	// serialization failure is returned to the caller.
+	TxMaxAttempts int
+}
+
+func NewModels(db *sql.DB, cfg Config) Models {
 	return Models{
-		Shop: ShopModel{DB: db},
+		Shop: ShopModel{
+			DB:            db,
+			Queries:       &Queries{db: db, timeout: cfg.QueryTimeout},
+			txIsolation:   cfg.TxIsolation,
+			txMaxAttempts: cfg.TxMaxAttempts,
+		},
+	}
+}
+
+// IsQueryTimeout reports whether err means that a query was cancelled because
+// its deadline passed.
+func IsQueryTimeout(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "query_canceled" {
+		return true
 	}
+	return errors.Is(err, context.DeadlineExceeded)
 }
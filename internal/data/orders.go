@@ -0,0 +1,237 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	OrderPlaced    = "placed"
+	OrderPicked    = "picked"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+)
+
+var OrderStatuses = []string{OrderPlaced, OrderPicked, OrderShipped, OrderDelivered, OrderCancelled}
+
+var ErrInvalidStatusTransition = errors.New("invalid order status transition")
+
+// orderTransitions lists the statuses an order may move to from each status.
+// Orders can be cancelled until they are shipped, delivered and cancelled
+// orders are final.
+var orderTransitions = map[string][]string{
+	OrderPlaced:  {OrderPicked, OrderCancelled},
+	OrderPicked:  {OrderShipped, OrderCancelled},
+	OrderShipped: {OrderDelivered},
+}
+
+type Order struct {
+	ID        int64        `json:"id"`
+	PublicID  string       `json:"publicId"`
+	UserID    int64        `json:"userId"`
+	Status    string       `json:"status"`
+	Total     int          `json:"total"`
+	Lines     []*OrderLine `json:"items"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+type OrderLine struct {
+	Item      string `json:"item"`
+	Quantity  int    `json:"quantity"`
+	Returned  int    `json:"returned"`
+	UnitPrice int    `json:"price"`
+	Total     int    `json:"total"`
+
+	itemID int64
+}
+
+// insertOrder records a purchase as a placed order with the prices paid and
+// sets the order's ids and creation time on the receipt.
+func (q *Queries) insertOrder(ctx context.Context, userID int64, receipt *Receipt) error {
+	stmt := `INSERT INTO orders (user_id, status, total) VALUES ($1, $2, $3) RETURNING id, public_id, created_at`
+
+	err := q.db.QueryRowContext(ctx, stmt, userID, OrderPlaced, receipt.Total).Scan(&receipt.OrderID, &receipt.PublicID, &receipt.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	stmt = `INSERT INTO order_lines (order_id, item_id, quantity, unit_price) VALUES ($1, $2, $3, $4)`
+	for _, line := range receipt.Lines {
+		if _, err := q.db.ExecContext(ctx, stmt, receipt.OrderID, line.itemID, line.Quantity, line.UnitPrice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetOrders lists orders newest first. A nil userID lists the orders of every
+// user, an empty status does not filter by status.
+func (q *Queries) GetOrders(ctx context.Context, userID *int64, status string, filters Filters) ([]*Order, Metadata, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, public_id, user_id, status, total, created_at, updated_at
+		FROM orders
+		WHERE ($1::int IS NULL OR user_id = $1)
+		AND ($2 = '' OR status = $2)
+		ORDER BY %s %s, id DESC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	rows, err := q.db.QueryContext(ctx, stmt, userID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	orders := []*Order{}
+	byID := make(map[int64]*Order)
+	ids := []int64{}
+
+	for rows.Next() {
+		var order Order
+		err := rows.Scan(&totalRecords, &order.ID, &order.PublicID, &order.UserID, &order.Status, &order.Total, &order.CreatedAt, &order.UpdatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		order.Lines = []*OrderLine{}
+		orders = append(orders, &order)
+		byID[order.ID] = &order
+		ids = append(ids, order.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	if err := q.loadOrderLines(ctx, ids, byID); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return orders, metadata, nil
+}
+
+func (q *Queries) loadOrderLines(ctx context.Context, ids []int64, byID map[int64]*Order) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	stmt := `
+		SELECT ol.order_id, ol.item_id, i.name, ol.quantity, ol.returned_quantity, ol.unit_price
+		FROM order_lines ol
+		JOIN items i ON i.id = ol.item_id
+		WHERE ol.order_id = ANY($1)
+		ORDER BY ol.order_id, i.name`
+
+	rows, err := q.db.QueryContext(ctx, stmt, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int64
+		var line OrderLine
+		if err := rows.Scan(&orderID, &line.itemID, &line.Item, &line.Quantity, &line.Returned, &line.UnitPrice); err != nil {
+			return err
+		}
+		line.Total = line.UnitPrice * line.Quantity
+		byID[orderID].Lines = append(byID[orderID].Lines, &line)
+	}
+	return rows.Err()
+}
+
+// UpdateOrderStatus moves an order to the next status of its lifecycle. A
+// cancelled order is refunded: the units that were not returned yet leave the
+// buyer's inventory, their price is credited back and limited items are
+// restocked.
+func (q *Queries) UpdateOrderStatus(ctx context.Context, orderID int64, status string, changedBy int64) (*Order, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		SELECT id, public_id, user_id, status, total, created_at, updated_at
+		FROM orders WHERE id = $1
+		FOR UPDATE`
+
+	var order Order
+	err := q.db.QueryRowContext(ctx, stmt, orderID).Scan(&order.ID, &order.PublicID, &order.UserID, &order.Status, &order.Total, &order.CreatedAt, &order.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	allowed := false
+	for _, next := range orderTransitions[order.Status] {
+		if next == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, ErrInvalidStatusTransition
+	}
+
+	order.Lines = []*OrderLine{}
+	if err := q.loadOrderLines(ctx, []int64{order.ID}, map[int64]*Order{order.ID: &order}); err != nil {
+		return nil, err
+	}
+
+	if status == OrderCancelled {
+		for _, line := range order.Lines {
+			if left := line.Quantity - line.Returned; left > 0 {
+				if _, err := q.refundOrderLine(ctx, &order, line, left, changedBy); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	stmt = `UPDATE orders SET status = $1, updated_at = now() WHERE id = $2 RETURNING updated_at`
+	err = q.db.QueryRowContext(ctx, stmt, status, order.ID).Scan(&order.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	order.Status = status
+	return &order, nil
+}
+
+// RemoveUserItem takes units out of the user's inventory, the entry is removed
+// when no units are left.
+func (q *Queries) RemoveUserItem(ctx context.Context, userID int64, itemID int64, quantity int) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `DELETE FROM user_items WHERE user_id = $1 AND item_id = $2 AND quantity <= $3`
+	result, err := q.db.ExecContext(ctx, stmt, userID, itemID, quantity)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+
+	stmt = `UPDATE user_items SET quantity = quantity - $3 WHERE user_id = $1 AND item_id = $2`
+	_, err = q.db.ExecContext(ctx, stmt, userID, itemID, quantity)
+	return err
+}
+
+// restockItem puts units back in stock, items with unlimited stock are not touched.
+func (q *Queries) restockItem(ctx context.Context, itemID int64, quantity int) error {
+	stmt := `UPDATE items SET stock = stock + $1 WHERE id = $2 AND stock IS NOT NULL`
+	_, err := q.db.ExecContext(ctx, stmt, quantity, itemID)
+	return err
+}
@@ -0,0 +1,46 @@
+package data
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrPasswordTooLong = errors.New("password is too long")
+)
+
+// HashPassword returns the bcrypt hash of the plaintext password.
+func HashPassword(plaintext string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), cost)
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			return "", ErrPasswordTooLong
+		}
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether plaintext matches the stored password.
+// Rows written before passwords were hashed hold the plaintext itself, those are
+// compared directly. rehash is true when the stored value should be replaced:
+// it is either legacy plaintext or a hash made with a different cost.
+func CheckPassword(stored string, plaintext string, cost int) (match bool, rehash bool, err error) {
+	storedCost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		// Not a bcrypt hash, so it is a legacy plaintext row
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(plaintext)) == 1
+		return match, match, nil
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(stored), []byte(plaintext))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	return true, storedCost != cost, nil
+}
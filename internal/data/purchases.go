@@ -0,0 +1,148 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+var (
+	ErrItemNotFound      = errors.New("item not found")
+	ErrItemArchived      = errors.New("item archived")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+)
+
+// PurchaseError tells which item of a purchase could not be bought.
+type PurchaseError struct {
+	Item string
+	Err  error
+}
+
+func (e *PurchaseError) Error() string {
+	return e.Item + ": " + e.Err.Error()
+}
+
+func (e *PurchaseError) Unwrap() error {
+	return e.Err
+}
+
+type PurchaseLine struct {
+	Item     string `json:"item"`
+	Quantity int    `json:"quantity"`
+}
+
+type PurchasedLine struct {
+	Item      string `json:"item"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int    `json:"price"`
+	Total     int    `json:"total"`
+
+	itemID        int64
+	purchaseLimit *int
+}
+
+type Receipt struct {
+	PublicID  string           `json:"id"`
+	OrderID   int64            `json:"orderId"`
+	Total     int              `json:"total"`
+	Lines     []*PurchasedLine `json:"items"`
+	CreatedAt time.Time        `json:"createdAt"`
+}
+
+func ValidatePurchaseLines(v *validator.Validator, lines []PurchaseLine) {
+	v.Check(len(lines) > 0, "items", "must contain at least one item")
+	v.Check(len(lines) <= 100, "items", "must not contain more than 100 lines")
+	for _, line := range lines {
+		v.Check(line.Item != "", "items", "item must be provided")
+		v.Check(line.Quantity > 0, "items", "quantity must be greater than zero")
+		v.Check(line.Quantity <= 1000, "items", "quantity must not be more than 1000")
+	}
+}
+
+// Purchase prices the lines against the current catalog and buys them for the
+// user: the total is debited once, stock is taken and the units are added to the
+// inventory. The purchase is recorded as a placed order and in the wallet
+// history of the user. Lines for the same
+// item are merged. Purchase must run inside WithTx, any failure rolls the
+// transaction back so either every line is bought or none is.
+func (q *Queries) Purchase(ctx context.Context, userID int64, lines []PurchaseLine) (*Receipt, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	// Lines of the same item are merged, in the order the items first appear
+	// so the item an error is reported for does not change between calls
+	var merged []*PurchasedLine
+	index := make(map[string]int)
+	for _, line := range lines {
+		if i, ok := index[line.Item]; ok {
+			merged[i].Quantity += line.Quantity
+			continue
+		}
+		index[line.Item] = len(merged)
+		merged = append(merged, &PurchasedLine{Item: line.Item, Quantity: line.Quantity})
+	}
+
+	receipt := &Receipt{}
+	stmt := `SELECT id, price, archived, purchase_limit FROM items WHERE name = $1`
+	for _, line := range merged {
+		var archived bool
+		err := q.db.QueryRowContext(ctx, stmt, line.Item).Scan(&line.itemID, &line.UnitPrice, &archived, &line.purchaseLimit)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, &PurchaseError{Item: line.Item, Err: ErrItemNotFound}
+			}
+			return nil, err
+		}
+		if archived {
+			return nil, &PurchaseError{Item: line.Item, Err: ErrItemArchived}
+		}
+		line.Total = line.UnitPrice * line.Quantity
+		receipt.Total += line.Total
+		receipt.Lines = append(receipt.Lines, line)
+	}
+	// Take item rows in a fixed order so concurrent purchases can't deadlock
+	sort.Slice(receipt.Lines, func(i, j int) bool {
+		return receipt.Lines[i].itemID < receipt.Lines[j].itemID
+	})
+
+	balances, err := q.LockUsers(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if balances[userID] < receipt.Total {
+		return nil, ErrInsufficientFunds
+	}
+	if err := q.UpdateUserBalanceAfterPurchase(ctx, userID, receipt.Total); err != nil {
+		return nil, err
+	}
+
+	for _, line := range receipt.Lines {
+		err := q.DecrementItemStock(ctx, line.itemID, line.Quantity)
+		if err != nil {
+			if errors.Is(err, ErrSoldOut) {
+				return nil, &PurchaseError{Item: line.Item, Err: err}
+			}
+			return nil, err
+		}
+		owned, err := q.InsertUserItem(ctx, userID, line.itemID, line.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		if line.purchaseLimit != nil && owned > *line.purchaseLimit {
+			return nil, &PurchaseError{Item: line.Item, Err: ErrPurchaseLimitExceeded}
+		}
+	}
+
+	if err := q.insertOrder(ctx, userID, receipt); err != nil {
+		return nil, err
+	}
+	err = q.postEntry(ctx, LedgerPurchase, receipt.PublicID, userPosting(userID, -receipt.Total), Posting{Account: AccountShop, Amount: receipt.Total})
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+// BalanceReport recomputes the balance of a user. Ledger is the sum of the
+// postings of the wallet, History is recomputed from the transfers, refunds
+// and orders of the user. The opening balance is only recorded in the ledger,
+// History starts from the opening postings and leaves the others aside.
+type BalanceReport struct {
+	UserID   int64
+	Username string
+	Stored   int
+	Ledger   int
+	History  int
+
+	Opening  int
+	Received int
+	Sent     int
+	Refunded int
+	Spent    int
+}
+
+// Consistent tells whether the stored balance, the ledger and the history agree.
+func (r *BalanceReport) Consistent() bool {
+	return r.Stored == r.Ledger && r.Ledger == r.History
+}
+
+type BalanceAdjustment struct {
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"userId"`
+	OldBalance int       `json:"oldBalance"`
+	NewBalance int       `json:"newBalance"`
+	Reason     string    `json:"reason"`
+	AdjustedBy int64     `json:"adjustedBy"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func ValidateAdjustmentReason(v *validator.Validator, reason string) {
+	v.Check(reason != "", "reason", "must be provided")
+	v.Check(len(reason) <= 64, "reason", "must not be more than 64 bytes long")
+	v.Check(validator.Matches(reason, validator.ReasonRX), "reason", "must contain only lowercase letters, digits, '_' or '-'")
+}
+
+// GetBalanceReports recomputes the balances of every user, or of a single user
+// when userID is not nil, ordered by user id.
+func (q *Queries) GetBalanceReports(ctx context.Context, userID *int64) ([]*BalanceReport, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		SELECT u.id, u.username, u.balance,
+			(SELECT COALESCE(sum(p.amount), 0) FROM ledger_postings p
+				WHERE p.account = 'user' AND p.user_id = u.id),
+			(SELECT COALESCE(sum(p.amount), 0) FROM ledger_postings p
+				JOIN ledger_entries e ON e.id = p.entry_id
+				WHERE e.kind = 'opening' AND p.account = 'user' AND p.user_id = u.id),
+			(SELECT COALESCE(sum(t.amount), 0) FROM transactions t WHERE t.to_user_id = u.id),
+			(SELECT COALESCE(sum(t.amount), 0) FROM transactions t WHERE t.from_user_id = u.id),
+			(SELECT COALESCE(sum(r.amount), 0) FROM refunds r WHERE r.user_id = u.id),
+			(SELECT COALESCE(sum(o.total), 0) FROM orders o WHERE o.user_id = u.id)
+		FROM users u
+		WHERE ($1::int IS NULL OR u.id = $1)
+		ORDER BY u.id`
+
+	rows, err := q.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []*BalanceReport{}
+	for rows.Next() {
+		var r BalanceReport
+		err := rows.Scan(&r.UserID, &r.Username, &r.Stored, &r.Ledger, &r.Opening, &r.Received, &r.Sent, &r.Refunded, &r.Spent)
+		if err != nil {
+			return nil, err
+		}
+		r.History = r.Opening + r.Received - r.Sent + r.Refunded - r.Spent
+		reports = append(reports, &r)
+	}
+	return reports, rows.Err()
+}
+
+// AdjustBalance sets the stored balance of a user and records the correction
+// with its reason. The user must be locked with LockUsers inside WithTx.
+func (q *Queries) AdjustBalance(ctx context.Context, userID int64, oldBalance, newBalance int, reason string, adjustedBy int64) (*BalanceAdjustment, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `UPDATE users SET balance = $1 WHERE id = $2`
+	if _, err := q.db.ExecContext(ctx, stmt, newBalance, userID); err != nil {
+		return nil, balanceError(err)
+	}
+
+	adjustment := &BalanceAdjustment{
+		UserID:     userID,
+		OldBalance: oldBalance,
+		NewBalance: newBalance,
+		Reason:     reason,
+		AdjustedBy: adjustedBy,
+	}
+	stmt = `
+		INSERT INTO balance_adjustments (user_id, old_balance, new_balance, reason, adjusted_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []any{userID, oldBalance, newBalance, reason, adjustedBy}
+	if err := q.db.QueryRowContext(ctx, stmt, args...).Scan(&adjustment.ID, &adjustment.CreatedAt); err != nil {
+		return nil, err
+	}
+	return adjustment, nil
+}
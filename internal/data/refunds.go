@@ -0,0 +1,164 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrOrderCancelled      = errors.New("order is cancelled")
+	ErrReturnWindowExpired = errors.New("return window expired")
+	ErrNothingToReturn     = errors.New("not enough units left to return")
+)
+
+type Refund struct {
+	ID        int64     `json:"id"`
+	OrderID   int64     `json:"orderId"`
+	Item      string    `json:"item"`
+	Quantity  int       `json:"quantity"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReturnRequest describes units of an order being returned. BuyerID is set when
+// the buyer returns the units themselves, the order must then be theirs and
+// must have been placed within Window. Admins return units with a nil BuyerID.
+type ReturnRequest struct {
+	OrderID    int64
+	Item       string
+	Quantity   int
+	BuyerID    *int64
+	Window     time.Duration
+	ReturnedBy int64
+}
+
+// ReturnOrderItem takes returned units back: they leave the buyer's inventory,
+// the price paid for them is credited back and limited items are restocked.
+func (q *Queries) ReturnOrderItem(ctx context.Context, req ReturnRequest) (*Refund, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		SELECT id, public_id, user_id, status, total, created_at, updated_at
+		FROM orders WHERE id = $1
+		FOR UPDATE`
+
+	var order Order
+	err := q.db.QueryRowContext(ctx, stmt, req.OrderID).Scan(&order.ID, &order.PublicID, &order.UserID, &order.Status, &order.Total, &order.CreatedAt, &order.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	if req.BuyerID != nil {
+		if order.UserID != *req.BuyerID {
+			return nil, ErrRecordNotFound
+		}
+		if time.Since(order.CreatedAt) > req.Window {
+			return nil, ErrReturnWindowExpired
+		}
+	}
+	if order.Status == OrderCancelled {
+		return nil, ErrOrderCancelled
+	}
+
+	order.Lines = []*OrderLine{}
+	if err := q.loadOrderLines(ctx, []int64{order.ID}, map[int64]*Order{order.ID: &order}); err != nil {
+		return nil, err
+	}
+
+	for _, line := range order.Lines {
+		if line.Item != req.Item {
+			continue
+		}
+		if line.Quantity-line.Returned < req.Quantity {
+			return nil, &PurchaseError{Item: req.Item, Err: ErrNothingToReturn}
+		}
+		return q.refundOrderLine(ctx, &order, line, req.Quantity, req.ReturnedBy)
+	}
+	return nil, &PurchaseError{Item: req.Item, Err: ErrItemNotFound}
+}
+
+// refundOrderLine returns units of an order line and records the refund. Rows
+// are locked in the order Purchase locks them, the buyer first, then the item
+// and the inventory, so refunds and purchases can't deadlock.
+func (q *Queries) refundOrderLine(ctx context.Context, order *Order, line *OrderLine, quantity int, refundedBy int64) (*Refund, error) {
+	if _, err := q.LockUsers(ctx, order.UserID); err != nil {
+		return nil, err
+	}
+
+	stmt := `UPDATE order_lines SET returned_quantity = returned_quantity + $1 WHERE order_id = $2 AND item_id = $3`
+	if _, err := q.db.ExecContext(ctx, stmt, quantity, order.ID, line.itemID); err != nil {
+		return nil, err
+	}
+	line.Returned += quantity
+
+	if err := q.restockItem(ctx, line.itemID, quantity); err != nil {
+		return nil, err
+	}
+	if err := q.RemoveUserItem(ctx, order.UserID, line.itemID, quantity); err != nil {
+		return nil, err
+	}
+
+	refund := &Refund{
+		OrderID:  order.ID,
+		Item:     line.Item,
+		Quantity: quantity,
+		Amount:   quantity * line.UnitPrice,
+	}
+	if err := q.UpdateReceiverBalance(ctx, order.UserID, refund.Amount); err != nil {
+		return nil, err
+	}
+	err := q.postEntry(ctx, LedgerRefund, order.PublicID, Posting{Account: AccountShop, Amount: -refund.Amount}, userPosting(order.UserID, refund.Amount))
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+		INSERT INTO refunds (order_id, item_id, user_id, quantity, amount, refunded_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{order.ID, line.itemID, order.UserID, quantity, refund.Amount, refundedBy}
+	if err := q.db.QueryRowContext(ctx, stmt, args...).Scan(&refund.ID, &refund.CreatedAt); err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// GetRefunds lists the latest refunds credited to the user, newest first.
+func (q *Queries) GetRefunds(ctx context.Context, userID int64, limit int) ([]*Refund, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		SELECT r.id, r.order_id, i.name, r.quantity, r.amount, r.created_at
+		FROM refunds r
+		JOIN items i ON i.id = r.item_id
+		WHERE r.user_id = $1
+		ORDER BY r.id DESC
+		LIMIT $2`
+
+	rows, err := q.db.QueryContext(ctx, stmt, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []*Refund{}
+	for rows.Next() {
+		var refund Refund
+		if err := rows.Scan(&refund.ID, &refund.OrderID, &refund.Item, &refund.Quantity, &refund.Amount, &refund.CreatedAt); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, &refund)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
@@ -1,46 +1,104 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+const (
+	RoleEmployee    = "employee"
+	RoleShopManager = "shop-manager"
+	RoleAdmin       = "admin"
 )
 
+var Roles = []string{RoleEmployee, RoleShopManager, RoleAdmin}
+
 type User struct {
 	ID       int64  `json:"id"`
 	Balance  int    `json:"coins"`
 	Username string `json:"username"`
 	Password string `json:"-"`
+	Role     string `json:"role"`
 }
 type Item struct {
 	ID       int64  `json:"-"`
 	Name     string `json:"item"`
 	Price    int    `json:"-"`
 	Quantity int    `json:"quantity"`
+	Archived bool   `json:"-"`
+	// PurchaseLimit caps the units a single user may own, nil means no cap
+	PurchaseLimit *int `json:"-"`
 }
 type UserItem struct {
 	User_id  int64
 	Item_id  int64
 	Quantity int
 }
-type Transcation struct {
-	ID         int64
-	FromUserID int
-	ToUserID   int
-	Amount     int
+
+// Transfer is a movement of coins between two users, FromUserID is zero for
+// minted coins.
+type Transfer struct {
+	PublicID   string    `json:"id"`
+	FromUserID int64     `json:"-"`
+	ToUserID   int64     `json:"-"`
+	FromUser   string    `json:"fromUser,omitempty"`
+	ToUser     string    `json:"toUser,omitempty"`
+	Amount     int       `json:"amount"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func ValidateUsername(v *validator.Validator, username string) {
+	v.Check(username != "", "username", "must be provided")
+	v.Check(utf8.RuneCountInString(username) >= 3, "username", "must be at least 3 characters long")
+	v.Check(utf8.RuneCountInString(username) <= 64, "username", "must not be more than 64 characters long")
+	v.Check(validator.Matches(username, validator.UsernameRX), "username", "must contain only letters, digits, '.', '_' or '-'")
+}
+
+func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+	v.Check(password != "", "password", "must be provided")
+	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
+	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
 }
 
+// ShopModel runs the shop queries against the connection pool. Queries that
+// must see a consistent state run in a transaction started by WithTx.
 type ShopModel struct {
 	DB *sql.DB
+	*Queries
+
+	txIsolation   sql.IsolationLevel
+	txMaxAttempts int
+}
+
+// Queries holds every query of the shop, run either against the connection pool
+// or inside a transaction.
+type Queries struct {
+	db      DBTX
+	timeout time.Duration
+}
+
+// withTimeout bounds a query by the query timeout, on top of any deadline the
+// request context already has.
+func (q *Queries) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, q.timeout)
 }
 
-func (m *ShopModel) GetUserByUsername(username string) (*User, error) {
-	stmt := `SELECT id, username, password, balance FROM users WHERE username = $1`
+func (q *Queries) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `SELECT id, username, password, balance, role FROM users WHERE username = $1`
 
-	row := m.DB.QueryRow(stmt, username)
+	row := q.db.QueryRowContext(ctx, stmt, username)
 
 	var user User
-	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Balance)
+	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Balance, &user.Role)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -50,19 +108,61 @@ func (m *ShopModel) GetUserByUsername(username string) (*User, error) {
 	return &user, nil
 }
 
-func (m *ShopModel) InsertUser(username string, password string) (*User, error) {
-	stmt := `INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id, balance`
+// InsertUser creates a user with the default balance, the coins are posted
+// from the mint to the new wallet in the same statement.
+func (q *Queries) InsertUser(ctx context.Context, username string, passwordHash string) (*User, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		WITH u AS (
+			INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id, balance, role
+		), e AS (
+			INSERT INTO ledger_entries (kind) SELECT 'opening' FROM u WHERE u.balance > 0 RETURNING id
+		), p AS (
+			INSERT INTO ledger_postings (entry_id, account, user_id, amount)
+			SELECT e.id, 'mint', NULL, -u.balance FROM e, u
+			UNION ALL
+			SELECT e.id, 'user', u.id, u.balance FROM e, u
+		)
+		SELECT id, balance, role FROM u`
 
 	var newUser User
-	err := m.DB.QueryRow(stmt, username, password).Scan(&newUser.ID, &newUser.Balance)
+	err := q.db.QueryRowContext(ctx, stmt, username, passwordHash).Scan(&newUser.ID, &newUser.Balance, &newUser.Role)
 	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+			return nil, ErrDuplicateUsername
+		}
 		return nil, err
 	}
 	newUser.Username = username
+	newUser.Password = passwordHash
 	return &newUser, nil
 }
 
-func (m *ShopModel) GetUserBalanceAndInventory(userID int64) (int, []Item, error) {
+func (q *Queries) UpdateUserPassword(ctx context.Context, userID int64, passwordHash string) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `UPDATE users SET password = $1 WHERE id = $2`
+	_, err := q.db.ExecContext(ctx, stmt, passwordHash, userID)
+	return err
+}
+
+func (q *Queries) UpdateUserRole(ctx context.Context, userID int64, role string) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `UPDATE users SET role = $1 WHERE id = $2`
+	_, err := q.db.ExecContext(ctx, stmt, role, userID)
+	return err
+}
+
+func (q *Queries) GetUserBalanceAndInventory(ctx context.Context, userID int64) (int, []Item, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	stmt := `
         SELECT u.balance, i.id, i.name, i.price, ui.quantity
         FROM users u
@@ -71,7 +171,7 @@ func (m *ShopModel) GetUserBalanceAndInventory(userID int64) (int, []Item, error
         WHERE u.id = $1
     `
 
-	rows, err := m.DB.Query(stmt, userID)
+	rows, err := q.db.QueryContext(ctx, stmt, userID)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -120,7 +220,7 @@ func (m *ShopModel) GetUserBalanceAndInventory(userID int64) (int, []Item, error
 
 	// If no rows were returned, fetch the user's balance separately
 	if !hasRows {
-		balance, err = m.GetUserBalance(userID)
+		balance, err = q.GetUserBalance(ctx, userID)
 		if err != nil {
 			return 0, nil, err
 		}
@@ -129,106 +229,189 @@ func (m *ShopModel) GetUserBalanceAndInventory(userID int64) (int, []Item, error
 	return balance, inventoryItems, nil
 }
 
-func (m *ShopModel) GetUserBalance(userID int64) (int, error) {
+func (q *Queries) GetUserBalance(ctx context.Context, userID int64) (int, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	stmt := `SELECT balance FROM users WHERE id = $1`
 	var balance int
-	err := m.DB.QueryRow(stmt, userID).Scan(&balance)
+	err := q.db.QueryRowContext(ctx, stmt, userID).Scan(&balance)
 	if err != nil {
 		return 0, err
 	}
 	return balance, nil
 }
 
-func (m *ShopModel) UpdateSenderBalance(tx *sql.Tx, userID int64, amount int) error {
+// LockUsers locks the rows of the users for the rest of the transaction and
+// returns their balances. Rows are locked in id order so that concurrent
+// transfers between the same users can't deadlock.
+func (q *Queries) LockUsers(ctx context.Context, userIDs ...int64) (map[int64]int, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `SELECT id, balance FROM users WHERE id = ANY($1) ORDER BY id FOR UPDATE`
+
+	rows, err := q.db.QueryContext(ctx, stmt, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := make(map[int64]int, len(userIDs))
+	for rows.Next() {
+		var id int64
+		var balance int
+		if err := rows.Scan(&id, &balance); err != nil {
+			return nil, err
+		}
+		balances[id] = balance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(balances) != len(userIDs) {
+		return nil, ErrRecordNotFound
+	}
+	return balances, nil
+}
+
+func (q *Queries) UpdateSenderBalance(ctx context.Context, userID int64, amount int) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	stmt := `UPDATE users SET balance = balance - $1 WHERE id = $2`
-	_, err := tx.Exec(stmt, amount, userID)
+	_, err := q.db.ExecContext(ctx, stmt, amount, userID)
+	return balanceError(err)
+}
+
+// balanceError reports a debit rejected by the balance >= 0 constraint as
+// ErrInsufficientFunds.
+func balanceError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "check_violation" {
+		return ErrInsufficientFunds
+	}
 	return err
 }
 
-func (m *ShopModel) UpdateReceiverBalance(tx *sql.Tx, userID int64, amount int) error {
+func (q *Queries) UpdateReceiverBalance(ctx context.Context, userID int64, amount int) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	stmt := `UPDATE users SET balance = balance + $1 WHERE id = $2`
-	_, err := tx.Exec(stmt, amount, userID)
+	_, err := q.db.ExecContext(ctx, stmt, amount, userID)
 	return err
 }
 
-func (m *ShopModel) InsertTransaction(tx *sql.Tx, fromUserID int64, toUserID int64, amount int) error {
+// InsertTransaction records a transfer between two users and posts it to the
+// ledger.
+func (q *Queries) InsertTransaction(ctx context.Context, fromUserID int64, toUserID int64, amount int) (*Transfer, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	stmt := `
 		INSERT INTO transactions (from_user_id, to_user_id, amount)
 		VALUES ($1, $2, $3)
+		RETURNING public_id, created_at
 	`
-	_, err := tx.Exec(stmt, fromUserID, toUserID, amount)
-	return err
-}
+	t := &Transfer{FromUserID: fromUserID, ToUserID: toUserID, Amount: amount}
+	err := q.db.QueryRowContext(ctx, stmt, fromUserID, toUserID, amount).Scan(&t.PublicID, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
 
-func (m *ShopModel) GetItemPrice(itemName string) (int, error) {
-	stmt := `SELECT price FROM items WHERE name = $1`
-	var price int
-	err := m.DB.QueryRow(stmt, itemName).Scan(&price)
+	err = q.postEntry(ctx, LedgerTransfer, t.PublicID, userPosting(fromUserID, -amount), userPosting(toUserID, amount))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return price, nil
+	return t, nil
 }
 
-func (m *ShopModel) UpdateUserBalanceAfterPurchase(tx *sql.Tx, userID int64, itemPrice int) error {
-	stmt := `UPDATE users SET balance = balance - $1 WHERE id = $2`
-	_, err := tx.Exec(stmt, itemPrice, userID)
-	return err
-}
+// InsertMintTransaction records coins created by an admin, minted coins have no
+// sender and are posted from the mint account.
+func (q *Queries) InsertMintTransaction(ctx context.Context, toUserID int64, amount int) (*Transfer, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
 
-func (m *ShopModel) InsertUserItem(tx *sql.Tx, userID int64, itemID int64) error {
-	stmt := `INSERT INTO user_items (user_id, item_id) VALUES ($1, $2)
-	ON CONFLICT (user_id, item_id)
-	DO UPDATE SET quantity = user_items.quantity+1
+	stmt := `
+		INSERT INTO transactions (from_user_id, to_user_id, amount)
+		VALUES (NULL, $1, $2)
+		RETURNING public_id, created_at
 	`
-	_, err := tx.Exec(stmt, userID, itemID)
-	return err
-}
-
-func (m *ShopModel) GetAllItems() ([]Item, error) {
-	stmt := `SELECT id, name, price FROM items`
+	t := &Transfer{ToUserID: toUserID, Amount: amount}
+	err := q.db.QueryRowContext(ctx, stmt, toUserID, amount).Scan(&t.PublicID, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := m.DB.Query(stmt)
+	err = q.postEntry(ctx, LedgerMint, t.PublicID, Posting{Account: AccountMint, Amount: -amount}, userPosting(toUserID, amount))
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return t, nil
+}
 
-	var items []Item
+func (q *Queries) GetItemPrice(ctx context.Context, itemName string) (int, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
 
-	for rows.Next() {
-		var i Item
-		err := rows.Scan(&i.ID, &i.Name, &i.Price)
-		if err != nil {
-			return nil, err
-		}
-		items = append(items, i)
+	stmt := `SELECT price FROM items WHERE name = $1`
+	var price int
+	err := q.db.QueryRowContext(ctx, stmt, itemName).Scan(&price)
+	if err != nil {
+		return 0, err
 	}
+	return price, nil
+}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+func (q *Queries) UpdateUserBalanceAfterPurchase(ctx context.Context, userID int64, itemPrice int) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `UPDATE users SET balance = balance - $1 WHERE id = $2`
+	_, err := q.db.ExecContext(ctx, stmt, itemPrice, userID)
+	return balanceError(err)
+}
 
-	return items, nil
+// InsertUserItem adds units to the user's inventory and returns how many units
+// of the item the user owns now.
+func (q *Queries) InsertUserItem(ctx context.Context, userID int64, itemID int64, quantity int) (int, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `INSERT INTO user_items (user_id, item_id, quantity) VALUES ($1, $2, $3)
+	ON CONFLICT (user_id, item_id)
+	DO UPDATE SET quantity = user_items.quantity+EXCLUDED.quantity
+	RETURNING quantity
+	`
+	var owned int
+	err := q.db.QueryRowContext(ctx, stmt, userID, itemID, quantity).Scan(&owned)
+	return owned, err
 }
 
-func (m *ShopModel) CheckUserOwnItem(userID int64, itemID int64) (bool, error) {
+func (q *Queries) CheckUserOwnItem(ctx context.Context, userID int64, itemID int64) (bool, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	stmt := `SELECT EXISTS(SELECT 1 FROM user_items WHERE user_id = $1 AND item_id = $2)`
 	var exists bool
-	err := m.DB.QueryRow(stmt, userID, itemID).Scan(&exists)
+	err := q.db.QueryRowContext(ctx, stmt, userID, itemID).Scan(&exists)
 	if err != nil {
 		return false, err
 	}
 	return exists, nil
 }
 
-func (m *ShopModel) GetUserByID(userID int64) (*User, error) {
-	stmt := `SELECT id, username, balance FROM users WHERE id = $1`
+func (q *Queries) GetUserByID(ctx context.Context, userID int64) (*User, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
 
-	row := m.DB.QueryRow(stmt, userID)
+	stmt := `SELECT id, username, balance, role FROM users WHERE id = $1`
+
+	row := q.db.QueryRowContext(ctx, stmt, userID)
 
 	var user User
-	err := row.Scan(&user.ID, &user.Username, &user.Balance)
+	err := row.Scan(&user.ID, &user.Username, &user.Balance, &user.Role)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -238,13 +421,16 @@ func (m *ShopModel) GetUserByID(userID int64) (*User, error) {
 	return &user, nil
 }
 
-func (m *ShopModel) GetItemByName(itemName string) (*Item, error) {
-	stmt := `SELECT id, name, price FROM items WHERE name = $1`
+func (q *Queries) GetItemByName(ctx context.Context, itemName string) (*Item, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `SELECT id, name, price, archived, purchase_limit FROM items WHERE name = $1`
 
-	row := m.DB.QueryRow(stmt, itemName)
+	row := q.db.QueryRowContext(ctx, stmt, itemName)
 
 	var item Item
-	err := row.Scan(&item.ID, &item.Name, &item.Price)
+	err := row.Scan(&item.ID, &item.Name, &item.Price, &item.Archived, &item.PurchaseLimit)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -254,10 +440,13 @@ func (m *ShopModel) GetItemByName(itemName string) (*Item, error) {
 	return &item, nil
 }
 
-func (m *ShopModel) GetItemByID(itemID int64) (*Item, error) {
+func (q *Queries) GetItemByID(ctx context.Context, itemID int64) (*Item, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	stmt := `SELECT id, name, price FROM items WHERE id = $1`
 
-	row := m.DB.QueryRow(stmt, itemID)
+	row := q.db.QueryRowContext(ctx, stmt, itemID)
 
 	var item Item
 	err := row.Scan(&item.ID, &item.Name, &item.Price)
@@ -270,18 +459,17 @@ func (m *ShopModel) GetItemByID(itemID int64) (*Item, error) {
 	return &item, nil
 }
 
-func (m *ShopModel) GetUsersByIDs(userIDs []int64) (map[int64]*User, error) {
+func (q *Queries) GetUsersByIDs(ctx context.Context, userIDs []int64) (map[int64]*User, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	if len(userIDs) == 0 {
 		return nil, nil
 	}
 
-	query := `SELECT id, username FROM users WHERE id IN (` + strings.Repeat("?,", len(userIDs)-1) + `?)`
-	args := make([]interface{}, len(userIDs))
-	for i, id := range userIDs {
-		args[i] = id
-	}
+	query := `SELECT id, username FROM users WHERE id = ANY($1)`
 
-	rows, err := m.DB.Query(query, args...)
+	rows, err := q.db.QueryContext(ctx, query, pq.Array(userIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -303,76 +491,48 @@ func (m *ShopModel) GetUsersByIDs(userIDs []int64) (map[int64]*User, error) {
 	return users, nil
 }
 
-func (m *ShopModel) GetTransactionHistoryWithUsernames(userID int64) ([]struct {
-	FromUserID int64
-	ToUserID   int64
-	FromUser   string
-	ToUser     string
-	Amount     int
-}, error) {
+// GetTransactionHistoryWithUsernames returns the latest transfers sent and
+// received by the user, newest first.
+func (q *Queries) GetTransactionHistoryWithUsernames(ctx context.Context, userID int64, limit int) ([]*Transfer, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	stmt := `
 		SELECT
-			t.from_user_id, t.to_user_id,
+			t.public_id, t.from_user_id, t.to_user_id,
 			u1.username AS from_user,
 			u2.username AS to_user,
-			t.amount
+			t.amount, t.created_at
 		FROM transactions t
 		LEFT JOIN users u1 ON t.from_user_id = u1.id
 		LEFT JOIN users u2 ON t.to_user_id = u2.id
 		WHERE t.from_user_id = $1 OR t.to_user_id = $1
 		ORDER BY t.id DESC
+		LIMIT $2
 	`
 
-	rows, err := m.DB.Query(stmt, userID)
+	rows, err := q.db.QueryContext(ctx, stmt, userID, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var transactions []struct {
-		FromUserID int64
-		ToUserID   int64
-		FromUser   string
-		ToUser     string
-		Amount     int
-	}
-
+	transactions := []*Transfer{}
 	for rows.Next() {
-		var t struct {
-			FromUserID int64
-			ToUserID   int64
-			FromUser   sql.NullString
-			ToUser     sql.NullString
-			Amount     int
-		}
-		if err := rows.Scan(&t.FromUserID, &t.ToUserID, &t.FromUser, &t.ToUser, &t.Amount); err != nil {
+		// Minted coins have no sender
+		var (
+			t          Transfer
+			fromUserID sql.NullInt64
+			fromUser   sql.NullString
+			toUser     sql.NullString
+		)
+		if err := rows.Scan(&t.PublicID, &fromUserID, &t.ToUserID, &fromUser, &toUser, &t.Amount, &t.CreatedAt); err != nil {
 			return nil, err
 		}
-
-		// Convert sql.NullString to string, handling NULL values
-		fromUser := ""
-		if t.FromUser.Valid {
-			fromUser = t.FromUser.String
-		}
-
-		toUser := ""
-		if t.ToUser.Valid {
-			toUser = t.ToUser.String
-		}
-
-		transactions = append(transactions, struct {
-			FromUserID int64
-			ToUserID   int64
-			FromUser   string
-			ToUser     string
-			Amount     int
-		}{
-			FromUserID: t.FromUserID,
-			ToUserID:   t.ToUserID,
-			FromUser:   fromUser,
-			ToUser:     toUser,
-			Amount:     t.Amount,
-		})
+		t.FromUserID = fromUserID.Int64
+		t.FromUser = fromUser.String
+		t.ToUser = toUser.String
+		transactions = append(transactions, &t)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -382,59 +542,67 @@ func (m *ShopModel) GetTransactionHistoryWithUsernames(userID int64) ([]struct {
 	return transactions, nil
 }
 
-/*
-func (m *ShopModel) GetTransactionHistoryWithUsernames(userID int64) ([]struct {
-	FromUserID int64
-	ToUserID   int64
-	FromUser   string
-	ToUser     string
-	Amount     int
-}, error) {
+// CounterpartyTotal sums the coins moved between the user and another user in
+// one direction. The user is empty for minted coins.
+type CounterpartyTotal struct {
+	User           string
+	Amount         int
+	Count          int
+	LastTransferAt time.Time
+}
+
+// GetTransferTotals groups the transfers of the user by counterparty, separately
+// for the coins received and sent, largest amounts first. At most limit
+// counterparties are returned in each direction.
+func (q *Queries) GetTransferTotals(ctx context.Context, userID int64, limit int) (received, sent []*CounterpartyTotal, err error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
 	stmt := `
-		SELECT
-			t.from_user_id, t.to_user_id,
-			u1.username AS from_user,
-			u2.username AS to_user,
-			t.amount
-		FROM transactions t
-		LEFT JOIN users u1 ON t.from_user_id = u1.id
-		LEFT JOIN users u2 ON t.to_user_id = u2.id
-		WHERE t.from_user_id = $1 OR t.to_user_id = $1
-		ORDER BY t.id DESC
+		SELECT received, username, amount, count, last_transfer_at
+		FROM (
+			SELECT t.received, u.username, sum(t.amount) AS amount, count(*) AS count,
+				max(t.created_at) AS last_transfer_at,
+				row_number() OVER (PARTITION BY t.received ORDER BY sum(t.amount) DESC, u.username) AS rank
+			FROM (
+				SELECT true AS received, from_user_id AS counterparty, amount, created_at
+				FROM transactions WHERE to_user_id = $1
+				UNION ALL
+				SELECT false, to_user_id, amount, created_at
+				FROM transactions WHERE from_user_id = $1
+			) t
+			LEFT JOIN users u ON u.id = t.counterparty
+			GROUP BY t.received, t.counterparty, u.username
+		) totals
+		WHERE rank <= $2
+		ORDER BY amount DESC, username
 	`
 
-	rows, err := m.DB.Query(stmt, userID)
+	rows, err := q.db.QueryContext(ctx, stmt, userID, limit)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer rows.Close()
 
-	var transactions []struct {
-		FromUserID int64
-		ToUserID   int64
-		FromUser   string
-		ToUser     string
-		Amount     int
-	}
-
+	received, sent = []*CounterpartyTotal{}, []*CounterpartyTotal{}
 	for rows.Next() {
-		var t struct {
-			FromUserID int64
-			ToUserID   int64
-			FromUser   string
-			ToUser     string
-			Amount     int
+		var (
+			total      CounterpartyTotal
+			isReceived bool
+			user       sql.NullString
+		)
+		if err := rows.Scan(&isReceived, &user, &total.Amount, &total.Count, &total.LastTransferAt); err != nil {
+			return nil, nil, err
 		}
-		if err := rows.Scan(&t.FromUserID, &t.ToUserID, &t.FromUser, &t.ToUser, &t.Amount); err != nil {
-			return nil, err
+		total.User = user.String
+		if isReceived {
+			received = append(received, &total)
+		} else {
+			sent = append(sent, &total)
 		}
-		transactions = append(transactions, t)
 	}
-
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	return transactions, nil
+	return received, sent, nil
 }
-*/
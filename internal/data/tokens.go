@@ -0,0 +1,220 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+	ErrTokenReused  = errors.New("refresh token reuse detected")
+)
+
+type RefreshToken struct {
+	Plaintext string
+	Hash      []byte
+	UserID    int64
+	Family    string
+	Expiry    time.Time
+}
+
+// GenerateRefreshToken creates a new refresh token for the user. An empty family
+// starts a new family, rotated tokens keep the family of the token they replace.
+func GenerateRefreshToken(userID int64, ttl time.Duration, family string) (*RefreshToken, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, err
+	}
+	if family == "" {
+		var err error
+		family, err = GenerateTokenID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	token := &RefreshToken{
+		Plaintext: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes),
+		UserID:    userID,
+		Family:    family,
+		Expiry:    time.Now().Add(ttl),
+	}
+	token.Hash = HashToken(token.Plaintext)
+	return token, nil
+}
+
+// GenerateTokenID returns a random identifier used for access token ids and refresh token families.
+func GenerateTokenID() (string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+func HashToken(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+func (q *Queries) InsertRefreshToken(ctx context.Context, token *RefreshToken) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		INSERT INTO refresh_tokens (token_hash, user_id, family, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := q.db.ExecContext(ctx, stmt, token.Hash, token.UserID, token.Family, token.Expiry)
+	return err
+}
+
+// RotateRefreshToken revokes the presented refresh token and issues its replacement
+// in the same family. Presenting a token that was already revoked means it leaked,
+// so the whole family is revoked and ErrTokenReused is returned.
+func (m *ShopModel) RotateRefreshToken(ctx context.Context, plaintext string, ttl time.Duration) (*RefreshToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var token *RefreshToken
+	reused := false
+
+	err := m.WithTx(ctx, func(q *Queries) error {
+		reused = false
+
+		stmt := `
+			SELECT id, user_id, family, expires_at, revoked_at
+			FROM refresh_tokens
+			WHERE token_hash = $1
+			FOR UPDATE
+		`
+		var (
+			id        int64
+			userID    int64
+			family    string
+			expiry    time.Time
+			revokedAt sql.NullTime
+		)
+		err := q.db.QueryRowContext(ctx, stmt, HashToken(plaintext)).Scan(&id, &userID, &family, &expiry, &revokedAt)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrInvalidToken
+			}
+			return err
+		}
+
+		if revokedAt.Valid {
+			// Commit the revocation of the family before reporting the reuse
+			reused = true
+			stmt = `UPDATE refresh_tokens SET revoked_at = now() WHERE family = $1 AND revoked_at IS NULL`
+			_, err := q.db.ExecContext(ctx, stmt, family)
+			return err
+		}
+		if time.Now().After(expiry) {
+			return ErrInvalidToken
+		}
+
+		stmt = `UPDATE refresh_tokens SET revoked_at = now() WHERE id = $1`
+		if _, err := q.db.ExecContext(ctx, stmt, id); err != nil {
+			return err
+		}
+
+		token, err = GenerateRefreshToken(userID, ttl, family)
+		if err != nil {
+			return err
+		}
+		return q.InsertRefreshToken(ctx, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, ErrTokenReused
+	}
+	return token, nil
+}
+
+// RevokeRefreshTokenFamily revokes every token in the family of the given refresh token.
+func (q *Queries) RevokeRefreshTokenFamily(ctx context.Context, plaintext string, userID int64) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		UPDATE refresh_tokens SET revoked_at = now()
+		WHERE revoked_at IS NULL AND family = (
+			SELECT family FROM refresh_tokens WHERE token_hash = $1 AND user_id = $2
+		)
+	`
+	_, err := q.db.ExecContext(ctx, stmt, HashToken(plaintext), userID)
+	return err
+}
+
+// RevokeToken adds an access token id to the revocation list until the token expires.
+func (q *Queries) RevokeToken(ctx context.Context, jti string, expiry time.Time) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`
+	_, err := q.db.ExecContext(ctx, stmt, jti, expiry)
+	return err
+}
+
+// RevokeUserSessions invalidates every access token issued to the user so far and
+// all of the user's refresh tokens. The time is taken from the clock the access
+// tokens are stamped with, at full precision, so a login right after the
+// revocation is not caught by it.
+func (m *ShopModel) RevokeUserSessions(ctx context.Context, userID int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	revokedAt := time.Now()
+	return m.WithTx(ctx, func(q *Queries) error {
+		stmt := `UPDATE users SET sessions_revoked_at = $2 WHERE id = $1`
+		if _, err := q.db.ExecContext(ctx, stmt, userID, revokedAt); err != nil {
+			return err
+		}
+		stmt = `UPDATE refresh_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`
+		_, err := q.db.ExecContext(ctx, stmt, userID)
+		return err
+	})
+}
+
+// IsTokenRevoked reports whether the access token was revoked by id or was issued
+// before the user's sessions were revoked.
+func (q *Queries) IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1)
+			OR EXISTS(SELECT 1 FROM users WHERE id = $2 AND sessions_revoked_at > $3)
+	`
+	var revoked bool
+	err := q.db.QueryRowContext(ctx, stmt, jti, userID, issuedAt).Scan(&revoked)
+	if err != nil {
+		return false, err
+	}
+	return revoked, nil
+}
+
+func (q *Queries) DeleteExpiredTokens(ctx context.Context) error {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `DELETE FROM revoked_tokens WHERE expires_at < now()`
+	if _, err := q.db.ExecContext(ctx, stmt); err != nil {
+		return err
+	}
+	stmt = `DELETE FROM refresh_tokens WHERE expires_at < now()`
+	_, err := q.db.ExecContext(ctx, stmt)
+	return err
+}
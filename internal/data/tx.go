@@ -0,0 +1,95 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TxRetries counts the transactions run again after a serialization failure or
+// a deadlock.
+var TxRetries = expvar.NewInt("tx_retries")
+
+const (
+	txRetryBaseDelay = 10 * time.Millisecond
+	txRetryMaxDelay  = 500 * time.Millisecond
+)
+
+// WithTx runs fn in a transaction. The transaction is rolled back if fn returns
+// an error or panics and committed otherwise. Transactions failing because of a
+// serialization failure or a deadlock are run again after a jittered backoff,
+// up to the configured number of attempts, so fn must not have side effects
+// outside of the transaction.
+func (m *ShopModel) WithTx(ctx context.Context, fn func(q *Queries) error) error {
+	return retryTx(ctx, m.txMaxAttempts, func() error {
+		return m.runTx(ctx, fn)
+	})
+}
+
+// retryTx calls run until it succeeds, fails with an error which is not a
+// serialization failure, maxAttempts calls were made or ctx is done.
+func retryTx(ctx context.Context, maxAttempts int, run func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := run()
+		if err == nil || !IsSerializationFailure(err) || attempt >= maxAttempts {
+			return err
+		}
+		TxRetries.Add(1)
+
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (m *ShopModel) runTx(ctx context.Context, fn func(q *Queries) error) (err error) {
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{Isolation: m.txIsolation})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = fn(&Queries{db: tx, timeout: m.timeout}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retryDelay returns a random delay up to an exponentially growing bound, so
+// that transactions which collided don't collide again.
+func retryDelay(attempt int) time.Duration {
+	bound := txRetryBaseDelay << (attempt - 1)
+	if bound <= 0 || bound > txRetryMaxDelay {
+		bound = txRetryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(bound)) + 1)
+}
+
+// IsSerializationFailure reports whether err is a transient failure that goes
+// away when the transaction is run again.
+func IsSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code.Name() {
+	case "serialization_failure", "deadlock_detected":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	errSerialization = &pq.Error{Code: "40001"}
+	errDeadlock      = &pq.Error{Code: "40P01"}
+	errUnique        = &pq.Error{Code: "23505"}
+)
+
+func TestIsSerializationFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", errSerialization, true},
+		{"deadlock", errDeadlock, true},
+		{"wrapped", fmt.Errorf("transfer: %w", errSerialization), true},
+		{"other postgres error", errUnique, false},
+		{"not a postgres error", errors.New("serialization_failure"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsSerializationFailure(tt.err); got != tt.want {
+			t.Errorf("%s: IsSerializationFailure = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 1; attempt <= 70; attempt++ {
+		bound := txRetryBaseDelay << (attempt - 1)
+		if bound <= 0 || bound > txRetryMaxDelay {
+			bound = txRetryMaxDelay
+		}
+		for i := 0; i < 100; i++ {
+			d := retryDelay(attempt)
+			if d <= 0 || d > bound {
+				t.Fatalf("attempt %d: delay %v out of (0, %v]", attempt, d, bound)
+			}
+		}
+	}
+}
+
+func TestRetryTx(t *testing.T) {
+	tests := []struct {
+		name        string
+		errs        []error
+		maxAttempts int
+		wantCalls   int
+		wantErr     error
+	}{
+		{"success", []error{nil}, 5, 1, nil},
+		{"retried until success", []error{errSerialization, errDeadlock, nil}, 5, 3, nil},
+		{"other errors are not retried", []error{errUnique}, 5, 1, errUnique},
+		{"gives up after max attempts", []error{errSerialization, errSerialization, errSerialization}, 3, 3, errSerialization},
+		{"single attempt", []error{errDeadlock}, 1, 1, errDeadlock},
+	}
+	for _, tt := range tests {
+		calls := 0
+		err := retryTx(context.Background(), tt.maxAttempts, func() error {
+			err := tt.errs[calls]
+			calls++
+			return err
+		})
+		if calls != tt.wantCalls {
+			t.Errorf("%s: %d calls, want %d", tt.name, calls, tt.wantCalls)
+		}
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRetryTxStopsWhenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	start := time.Now()
+	err := retryTx(ctx, 100, func() error {
+		calls++
+		return errSerialization
+	})
+	if !errors.Is(err, errSerialization) {
+		t.Errorf("err = %v, want the last failure", err)
+	}
+	// The backoff races the done context, one retry may still slip through
+	if calls > 2 || time.Since(start) > time.Second {
+		t.Errorf("%d calls in %v after the context was done", calls, time.Since(start))
+	}
+}
@@ -0,0 +1,49 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// WalletEntry records coins leaving the wallet of a user for merch, one entry
+// per order line with the price paid at the time.
+type WalletEntry struct {
+	PublicID  string    `json:"id"`
+	OrderID   int64     `json:"orderId"`
+	Item      string    `json:"item"`
+	Quantity  int       `json:"quantity"`
+	UnitPrice int       `json:"price"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GetPurchases lists the latest items bought by the user, newest first.
+func (q *Queries) GetPurchases(ctx context.Context, userID int64, limit int) ([]*WalletEntry, error) {
+	ctx, cancel := q.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		SELECT ol.public_id, o.id, i.name, ol.quantity, ol.unit_price, ol.quantity * ol.unit_price, o.created_at
+		FROM order_lines ol
+		JOIN orders o ON o.id = ol.order_id
+		JOIN items i ON i.id = ol.item_id
+		WHERE o.user_id = $1
+		ORDER BY o.id DESC, i.name
+		LIMIT $2`
+
+	rows, err := q.db.QueryContext(ctx, stmt, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*WalletEntry{}
+	for rows.Next() {
+		var e WalletEntry
+		if err := rows.Scan(&e.PublicID, &e.OrderID, &e.Item, &e.Quantity, &e.UnitPrice, &e.Amount, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
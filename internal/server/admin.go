@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/wisp167/Shop/internal/data"
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+func (app *Application) setUserRoleHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.setUserRoleWorker(w, r, ps)
+}
+
+func (app *Application) setUserRoleWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request struct {
+		Role string `json:"role"`
+	}
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	v.Check(validator.PermittedValue(request.Role, data.Roles...), "role", "must be one of employee, shop-manager or admin")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Shop.GetUserByUsername(r.Context(), ps.ByName("username"))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if user == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if err := app.models.Shop.UpdateUserRole(r.Context(), user.ID, request.Role); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Tokens carry the role, revoke them so the new role takes effect immediately
+	if err := app.models.Shop.RevokeUserSessions(r.Context(), user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.logger.Printf("Role of user %q changed from %s to %s", user.Username, user.Role, request.Role)
+
+	user.Role = request.Role
+	app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+}
+
+func (app *Application) revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.revokeUserSessionsWorker(w, r, ps)
+}
+
+func (app *Application) revokeUserSessionsWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, err := app.models.Shop.GetUserByUsername(r.Context(), ps.ByName("username"))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if user == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if err := app.models.Shop.RevokeUserSessions(r.Context(), user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.logger.Printf("Sessions of user %q revoked", user.Username)
+
+	app.writeJSON(w, http.StatusOK, envelope{}, nil)
+}
+
+func (app *Application) unlockLoginHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.unlockLoginWorker(w, r, ps)
+}
+
+// unlockLoginWorker forgets the failed logins of a username, the addresses the
+// attempts came from stay throttled until their lockout expires.
+func (app *Application) unlockLoginWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	adminID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return
+	}
+
+	username := ps.ByName("username")
+	unlocked, err := app.models.Shop.ClearLoginFailures(r.Context(), username)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if unlocked {
+		app.logger.Printf("Logins of %q unlocked by user %d", username, adminID)
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"unlocked": unlocked}, nil)
+}
+
+func (app *Application) checkBalanceHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.checkBalanceWorker(w, r, ps)
+}
+
+// checkBalanceWorker derives the balance of a user from the ledger and compares
+// it with the balance stored on the user.
+func (app *Application) checkBalanceWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, err := app.models.Shop.GetUserByUsername(r.Context(), ps.ByName("username"))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if user == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	check, err := app.models.Shop.CheckBalance(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !check.Consistent {
+		app.logger.Printf("Balance of user %q is %d, the ledger gives %d", user.Username, check.Stored, check.Ledger)
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"balance": check}, nil)
+}
+
+func (app *Application) mintCoinsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.mintCoinsWorker(w, r, ps)
+}
+
+func (app *Application) mintCoinsWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (err error) {
+	var request struct {
+		Amount   int    `json:"amount"`
+		Receiver string `json:"toUser"`
+	}
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return err
+	}
+	if request.Amount <= 0 || request.Receiver == "" {
+		app.badRequestResponse(w, r)
+		return errors.New("invalid request")
+	}
+
+	receiver, err := app.models.Shop.GetUserByUsername(r.Context(), request.Receiver)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return err
+	}
+	if receiver == nil {
+		app.badRequestResponse(w, r)
+		return errors.New("receiver not found")
+	}
+
+	var transfer *data.Transfer
+	err = app.models.Shop.WithTx(r.Context(), func(q *data.Queries) error {
+		if err := q.UpdateReceiverBalance(r.Context(), receiver.ID, request.Amount); err != nil {
+			return err
+		}
+		transfer, err = q.InsertMintTransaction(r.Context(), receiver.ID, request.Amount)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return err
+	}
+
+	adminID, _ := r.Context().Value("id").(int64)
+	app.logger.Printf("Admin %d minted %d coins for user %q", adminID, request.Amount, receiver.Username)
+
+	transfer.ToUser = receiver.Username
+	app.writeJSON(w, http.StatusOK, envelope{"transfer": transfer}, nil)
+	return nil
+}
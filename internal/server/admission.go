@@ -0,0 +1,151 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// admissionStats publishes the in-flight, waiting and rejected requests of
+// every endpoint as "<endpoint>.in_flight", "<endpoint>.waiting" and
+// "<endpoint>.rejected".
+var admissionStats = expvar.NewMap("admission")
+
+// admissionLimiter bounds how many requests of an endpoint run at once. When
+// every slot is taken, up to maxWaiting requests wait for a slot for at most
+// timeout, the others are rejected right away.
+type admissionLimiter struct {
+	name    string
+	slots   chan struct{}
+	waiting chan struct{}
+	timeout time.Duration
+}
+
+func newAdmissionLimiter(name string, limit, maxWaiting int, timeout time.Duration) *admissionLimiter {
+	return &admissionLimiter{
+		name:    name,
+		slots:   make(chan struct{}, limit),
+		waiting: make(chan struct{}, maxWaiting),
+		timeout: timeout,
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there is room in it. It
+// reports false when the request was not admitted.
+func (l *admissionLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		admissionStats.Add(l.name+".in_flight", 1)
+		return true
+	default:
+	}
+
+	select {
+	case l.waiting <- struct{}{}:
+	default:
+		return false
+	}
+	admissionStats.Add(l.name+".waiting", 1)
+	defer func() {
+		<-l.waiting
+		admissionStats.Add(l.name+".waiting", -1)
+	}()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		admissionStats.Add(l.name+".in_flight", 1)
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *admissionLimiter) release() {
+	<-l.slots
+	admissionStats.Add(l.name+".in_flight", -1)
+}
+
+// admit runs next once the endpoint's limiter admits the request and answers
+// 429 Too Many Requests otherwise. Routes admitted under the same endpoint name
+// share a limiter.
+func (app *Application) admit(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	limiter, ok := app.limiters[endpoint]
+	if !ok {
+		limit := app.config.admission.maxConcurrent
+		if n, ok := app.config.admission.limits[endpoint]; ok {
+			limit = n
+		}
+		limiter = newAdmissionLimiter(endpoint, limit, app.config.admission.maxWaiting, app.config.admission.waitTimeout)
+		app.limiters[endpoint] = limiter
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.acquire(r) {
+			admissionStats.Add(endpoint+".rejected", 1)
+			app.tooManyRequestsResponse(w, r, limiter.timeout)
+			return
+		}
+		defer limiter.release()
+
+		next(w, r)
+	}
+}
+
+// admitHandle is admit for the routes behind jwtMiddleware, it lets the token
+// check and the per-user rate limit turn clients away before they take a slot.
+func (app *Application) admitHandle(endpoint string, next httprouter.Handle) httprouter.Handle {
+	admitted := app.admit(endpoint, wrapHandle(next))
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		admitted(w, r)
+	}
+}
+
+// checkAdmissionLimits rejects limits configured for endpoints no route is
+// admitted under, so a misspelt endpoint name is not silently ignored. It must
+// run once the routes are built.
+func (app *Application) checkAdmissionLimits() error {
+	for endpoint := range app.config.admission.limits {
+		if _, ok := app.limiters[endpoint]; !ok {
+			return fmt.Errorf("admission limit set for unknown endpoint %q", endpoint)
+		}
+	}
+	return nil
+}
+
+// parseAdmissionLimits parses per-endpoint limits written as
+// "endpoint=limit,endpoint=limit".
+func parseAdmissionLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		endpoint, limit, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid admission limit %q", pair)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid admission limit %q", pair)
+		}
+		limits[strings.TrimSpace(endpoint)] = n
+	}
+	return limits, nil
+}
+
+// retryAfterSeconds rounds d up to the whole seconds expected by Retry-After.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestApplication() *Application {
+	app := &Application{
+		logger:       log.New(io.Discard, "", 0),
+		limiters:     make(map[string]*admissionLimiter),
+		rateLimiters: make(map[string]*rateLimiter),
+		done:         make(chan struct{}),
+	}
+	app.config.admission.maxConcurrent = 1
+	app.config.admission.waitTimeout = 50 * time.Millisecond
+	return app
+}
+
+// blockingHandler holds its slot until release is closed.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func serve(h http.HandlerFunc) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec
+}
+
+func TestAdmitRejectsWhenFull(t *testing.T) {
+	app := newTestApplication()
+	started, release := make(chan struct{}), make(chan struct{})
+	h := app.admit("test", blockingHandler(started, release))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(h) }()
+	<-started
+
+	// No queue: the second request is rejected right away
+	rec := serve(h)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want %q", got, "1")
+	}
+
+	close(release)
+	if rec := <-done; rec.Code != http.StatusOK {
+		t.Errorf("admitted request status = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdmitQueuesUntilTimeout(t *testing.T) {
+	app := newTestApplication()
+	app.config.admission.maxWaiting = 1
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	h := app.admit("test", blockingHandler(started, release))
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- serve(h) }()
+	<-started
+
+	// A waiting request times out while the slot stays taken
+	start := time.Now()
+	if rec := serve(h); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	if waited := time.Since(start); waited < app.config.admission.waitTimeout {
+		t.Errorf("rejected after %v, before the wait timeout", waited)
+	}
+
+	// A waiting request is admitted once the slot is released
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- serve(h) }()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for _, ch := range []chan *httptest.ResponseRecorder{first, second} {
+		if rec := <-ch; rec.Code != http.StatusOK {
+			t.Errorf("status = %d, want 200", rec.Code)
+		}
+	}
+}
+
+func TestAdmitSharesLimiterPerEndpoint(t *testing.T) {
+	app := newTestApplication()
+	app.config.admission.limits = map[string]int{"cart": 3}
+
+	app.admit("cart", func(http.ResponseWriter, *http.Request) {})
+	app.admit("cart", func(http.ResponseWriter, *http.Request) {})
+	app.admit("info", func(http.ResponseWriter, *http.Request) {})
+
+	if len(app.limiters) != 2 {
+		t.Fatalf("%d limiters, want one per endpoint", len(app.limiters))
+	}
+	if got := cap(app.limiters["cart"].slots); got != 3 {
+		t.Errorf("cart limit = %d, want 3", got)
+	}
+	if got := cap(app.limiters["info"].slots); got != 1 {
+		t.Errorf("info limit = %d, want the default 1", got)
+	}
+}
+
+func TestParseAdmissionLimits(t *testing.T) {
+	limits, err := parseAdmissionLimits(" buy=10, sendCoin = 5 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["buy"] != 10 || limits["sendCoin"] != 5 || len(limits) != 2 {
+		t.Errorf("limits = %v", limits)
+	}
+
+	for _, value := range []string{"buy", "buy=", "buy=0", "buy=x"} {
+		if _, err := parseAdmissionLimits(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestCheckAdmissionLimits(t *testing.T) {
+	app := newTestApplication()
+	app.config.admission.limits = map[string]int{"sendCoin": 5}
+	app.routes()
+	if err := app.checkAdmissionLimits(); err != nil {
+		t.Errorf("known endpoint rejected: %v", err)
+	}
+
+	app = newTestApplication()
+	app.config.admission.limits = map[string]int{"sendcoin": 5}
+	app.routes()
+	if err := app.checkAdmissionLimits(); err == nil {
+		t.Error("misspelt endpoint accepted")
+	}
+}
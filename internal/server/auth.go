@@ -2,27 +2,55 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/julienschmidt/httprouter"
 	_ "github.com/lib/pq"
+	"github.com/wisp167/Shop/internal/data"
+	"github.com/wisp167/Shop/internal/validator"
 )
 
 type Claims struct {
 	Userid int64
+	Role   string
+	// IssuedAtMicro is the issue time in microseconds, the standard iat claim
+	// only has seconds
+	IssuedAtMicro int64 `json:"iat_us,omitempty"`
 	jwt.StandardClaims
 }
 
+// issuedAt returns when the token was issued. Tokens issued without
+// IssuedAtMicro are taken to be issued at the start of their second.
+func (c *Claims) issuedAt() time.Time {
+	if c.IssuedAtMicro != 0 {
+		return time.UnixMicro(c.IssuedAtMicro)
+	}
+	return time.Unix(c.IssuedAt, 0)
+}
+
 type AuthRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
 type AuthResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
+	AllSessions  bool   `json:"allSessions"`
 }
 
 func (app *Application) jwtMiddleware(next httprouter.Handle) http.HandlerFunc {
@@ -41,6 +69,9 @@ func (app *Application) jwtMiddleware(next httprouter.Handle) http.HandlerFunc {
 
 		claims := &Claims{}
 		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, errors.New("unexpected signing method")
+			}
 			return app.jwtkey, nil
 		})
 
@@ -49,8 +80,19 @@ func (app *Application) jwtMiddleware(next httprouter.Handle) http.HandlerFunc {
 			return
 		}
 
-		// Add the username to the request context
+		revoked, err := app.models.Shop.IsTokenRevoked(r.Context(), claims.Id, claims.Userid, claims.issuedAt())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if revoked {
+			http.Error(w, "Token revoked", http.StatusUnauthorized)
+			return
+		}
+
+		// Add the user id and the token claims to the request context
 		ctx := context.WithValue(r.Context(), "id", claims.Userid)
+		ctx = context.WithValue(ctx, "claims", claims)
 		r = r.WithContext(ctx)
 
 		// Call the next handler
@@ -58,13 +100,8 @@ func (app *Application) jwtMiddleware(next httprouter.Handle) http.HandlerFunc {
 	})
 }
 
-func (app *Application) authHandler(w http.ResponseWriter, r *http.Request) { // Modified to enqueue
-	app.queue <- struct{}{}
-	defer func() {
-		<-app.queue
-	}()
+func (app *Application) authHandler(w http.ResponseWriter, r *http.Request) {
 	app.authWorker(w, r, httprouter.Params{})
-
 }
 
 func (app *Application) authWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -74,43 +111,373 @@ func (app *Application) authWorker(w http.ResponseWriter, r *http.Request, ps ht
 		app.badRequestResponse(w, r)
 		return
 	}
-	// Validate user credentials (e.g., check against database)
-	// For simplicity, we'll assume the credentials are valid
-	user, err := app.models.Shop.GetUserByUsername(req.Username)
+	if req.Username == "" || req.Password == "" {
+		app.badRequestResponse(w, r)
+		return
+	}
+	// No user can have a longer username, don't let it reach the inserts
+	if utf8.RuneCountInString(req.Username) > data.MaxUsernameLength {
+		if app.config.autoRegister {
+			app.badRequestResponse(w, r)
+		} else {
+			app.authorizationErrorResponse(w, r)
+		}
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := app.loginWait(r.Context(), req.Username, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if wait > 0 {
+		app.loginLockedResponse(w, r, wait)
+		return
+	}
+
+	user, err := app.models.Shop.GetUserByUsername(r.Context(), req.Username)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	registered := false
 	if user == nil {
+		if !app.config.autoRegister {
+			if err := app.recordLoginFailure(r.Context(), req.Username, ip); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.authorizationErrorResponse(w, r)
+			return
+		}
+		hash, err := data.HashPassword(req.Password, app.config.bcryptCost)
 		if err != nil {
+			if errors.Is(err, data.ErrPasswordTooLong) {
+				app.badRequestResponse(w, r)
+				return
+			}
 			app.serverErrorResponse(w, r, err)
 			return
 		}
-		user, err = app.models.Shop.InsertUser(req.Username, req.Password)
+		user, err = app.models.Shop.InsertUser(r.Context(), req.Username, hash)
+		switch {
+		case err == nil:
+			registered = true
+		case errors.Is(err, data.ErrDuplicateUsername):
+			// A concurrent first login created the user, check the password against it
+			user, err = app.models.Shop.GetUserByUsername(r.Context(), req.Username)
+			if err == nil && user == nil {
+				err = errors.New("user created concurrently is missing")
+			}
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if !registered {
+		match, rehash, err := data.CheckPassword(user.Password, req.Password, app.config.bcryptCost)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
-		user.Password = req.Password
+		if !match {
+			if err := app.recordLoginFailure(r.Context(), req.Username, ip); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.authorizationErrorResponse(w, r)
+			return
+		}
+		if _, err := app.models.Shop.ClearLoginFailures(r.Context(), req.Username); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// Upgrade legacy plaintext rows and hashes made with an outdated cost
+		if rehash {
+			hash, err := data.HashPassword(req.Password, app.config.bcryptCost)
+			if err == nil {
+				err = app.models.Shop.UpdateUserPassword(r.Context(), user.ID, hash)
+			}
+			if err != nil {
+				app.logger.Printf("Error rehashing password for user %d: %v", user.ID, err)
+			}
+		}
+	}
+
+	response, err := app.createTokens(r.Context(), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Return the tokens
+	app.writeJSON(w, http.StatusOK, response, nil)
+}
+
+func (app *Application) registerHandler(w http.ResponseWriter, r *http.Request) {
+	app.registerWorker(w, r, httprouter.Params{})
+}
+
+func (app *Application) registerWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req AuthRequest
+	if err := app.readJSON(w, r, &req); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateUsername(v, req.Username)
+	data.ValidatePasswordPlaintext(v, req.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	hash, err := data.HashPassword(req.Password, app.config.bcryptCost)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	user, err := app.models.Shop.InsertUser(r.Context(), req.Username, hash)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateUsername) {
+			v.AddError("username", "a user with this username already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response, err := app.createTokens(r.Context(), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, response, nil)
+}
+
+func (app *Application) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	app.refreshWorker(w, r, httprouter.Params{})
+}
+
+func (app *Application) refreshWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req RefreshRequest
+	if err := app.readJSON(w, r, &req); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return
+	}
+	if req.RefreshToken == "" {
+		app.badRequestResponse(w, r)
+		return
+	}
+
+	refresh, err := app.models.Shop.RotateRefreshToken(r.Context(), req.RefreshToken, app.config.refreshTokenTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.Printf("Refresh token reuse detected, token family revoked")
+			app.authorizationErrorResponse(w, r)
+		case errors.Is(err, data.ErrInvalidToken):
+			app.authorizationErrorResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
-	if user.Password != req.Password {
+
+	// Pick up role changes made since the previous token was issued
+	user, err := app.models.Shop.GetUserByID(r.Context(), refresh.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if user == nil {
 		app.authorizationErrorResponse(w, r)
 		return
 	}
 
-	// Create JWT token
-	expirationTime := time.Now().Add(time.Hour)
+	token, err := app.createAccessToken(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := AuthResponse{Token: token, RefreshToken: refresh.Plaintext}
+	app.writeJSON(w, http.StatusOK, response, nil)
+}
+
+func (app *Application) logoutHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.logoutWorker(w, r, ps)
+}
+
+func (app *Application) logoutWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	// The body is optional, a bare logout only revokes the presented access token
+	var req LogoutRequest
+	if r.ContentLength != 0 {
+		if err := app.readJSON(w, r, &req); err != nil {
+			app.logger.Printf("Error reading JSON: %v", err)
+			app.badRequestResponse(w, r)
+			return
+		}
+	}
+
+	claims, ok := r.Context().Value("claims").(*Claims)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get token claims"))
+		return
+	}
+
+	err := app.models.Shop.RevokeToken(r.Context(), claims.Id, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if req.RefreshToken != "" {
+		err = app.models.Shop.RevokeRefreshTokenFamily(r.Context(), req.RefreshToken, claims.Userid)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if req.AllSessions {
+		err = app.models.Shop.RevokeUserSessions(r.Context(), claims.Userid)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{}, nil)
+}
+
+// createTokens issues an access token and a refresh token starting a new token family.
+func (app *Application) createTokens(ctx context.Context, user *data.User) (*AuthResponse, error) {
+	token, err := app.createAccessToken(user)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := data.GenerateRefreshToken(user.ID, app.config.refreshTokenTTL, "")
+	if err != nil {
+		return nil, err
+	}
+	err = app.models.Shop.InsertRefreshToken(ctx, refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthResponse{Token: token, RefreshToken: refresh.Plaintext}, nil
+}
+
+func (app *Application) createAccessToken(user *data.User) (string, error) {
+	jti, err := data.GenerateTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
 	claims := &Claims{
-		Userid: user.ID,
+		Userid:        user.ID,
+		Role:          user.Role,
+		IssuedAtMicro: now.UnixMicro(),
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(app.config.accessTokenTTL).Unix(),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(app.jwtkey)
+	return token.SignedString(app.jwtkey)
+}
+
+// requireRole only lets through requests whose token carries one of the given roles.
+// It must be wrapped by jwtMiddleware, which puts the claims into the context.
+func (app *Application) requireRole(next httprouter.Handle, roles ...string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		claims, ok := r.Context().Value("claims").(*Claims)
+		if !ok {
+			app.serverErrorResponse(w, r, errors.New("cannot get token claims"))
+			return
+		}
+		if !validator.PermittedValue(claims.Role, roles...) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next(w, r, ps)
+	}
+}
+
+// bootstrapAdmin makes sure the admin account from the configuration exists, which
+// is how the first admin of a fresh installation is created. An existing account is
+// only promoted when it has the configured password, so that somebody who registered
+// the name first cannot become an admin.
+func (app *Application) bootstrapAdmin() error {
+	if app.config.admin.username == "" {
+		return nil
+	}
+	ctx := context.Background()
+
+	user, err := app.models.Shop.GetUserByUsername(ctx, app.config.admin.username)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return err
+	}
+	if user == nil {
+		hash, err := data.HashPassword(app.config.admin.password, app.config.bcryptCost)
+		if err != nil {
+			return err
+		}
+		user, err = app.models.Shop.InsertUser(ctx, app.config.admin.username, hash)
+		if err != nil {
+			return err
+		}
+	} else {
+		match, _, err := data.CheckPassword(user.Password, app.config.admin.password, app.config.bcryptCost)
+		if err != nil {
+			return err
+		}
+		if !match {
+			return fmt.Errorf("user %q exists and its password does not match ADMIN_PASSWORD", user.Username)
+		}
 	}
 
-	// Return the token
-	response := AuthResponse{Token: tokenString}
-	app.writeJSON(w, http.StatusOK, response, nil)
+	if user.Role == data.RoleAdmin {
+		return nil
+	}
+	app.logger.Printf("Granting %s role to %q", data.RoleAdmin, user.Username)
+	return app.models.Shop.UpdateUserRole(ctx, user.ID, data.RoleAdmin)
+}
+
+// cleanupExpired periodically drops revocation entries and refresh tokens which
+// have expired and can no longer be presented, idempotency keys past their
+// retention and failed logins which no longer count.
+func (app *Application) cleanupExpired() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := app.models.Shop.DeleteExpiredTokens(context.Background()); err != nil {
+				app.logger.Printf("Error deleting expired tokens: %v", err)
+			}
+			if err := app.models.Shop.DeleteExpiredIdempotencyKeys(context.Background(), app.config.idempotencyRetention); err != nil {
+				app.logger.Printf("Error deleting expired idempotency keys: %v", err)
+			}
+			if err := app.models.Shop.DeleteStaleLoginFailures(context.Background(), app.config.login.policy.Lockout); err != nil {
+				app.logger.Printf("Error deleting stale login failures: %v", err)
+			}
+		case <-app.done:
+			return
+		}
+	}
 }
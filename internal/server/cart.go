@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/wisp167/Shop/internal/data"
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+func (app *Application) getCartHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.getCartWorker(w, r, ps)
+}
+
+func (app *Application) getCartWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return
+	}
+
+	cart, err := app.models.Shop.GetCart(r.Context(), userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, cart, nil)
+}
+
+func (app *Application) addCartItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.addCartItemWorker(w, r, ps)
+}
+
+func (app *Application) addCartItemWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request struct {
+		Item     string `json:"item"`
+		Quantity int    `json:"quantity"`
+	}
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	v.Check(request.Item != "", "item", "must be provided")
+	validateCartQuantity(v, request.Quantity)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return
+	}
+
+	err := app.models.Shop.AddCartLine(r.Context(), userID, request.Item, request.Quantity)
+	if err != nil {
+		app.cartErrorResponse(w, r, err)
+		return
+	}
+
+	app.getCartWorker(w, r, ps)
+}
+
+func (app *Application) updateCartItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.updateCartItemWorker(w, r, ps)
+}
+
+func (app *Application) updateCartItemWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	if validateCartQuantity(v, request.Quantity); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return
+	}
+
+	err := app.models.Shop.SetCartLineQuantity(r.Context(), userID, ps.ByName("item"), request.Quantity)
+	if err != nil {
+		app.cartErrorResponse(w, r, err)
+		return
+	}
+
+	app.getCartWorker(w, r, ps)
+}
+
+func (app *Application) removeCartItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.removeCartItemWorker(w, r, ps)
+}
+
+func (app *Application) removeCartItemWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return
+	}
+
+	err := app.models.Shop.RemoveCartLine(r.Context(), userID, ps.ByName("item"))
+	if err != nil {
+		app.cartErrorResponse(w, r, err)
+		return
+	}
+
+	app.getCartWorker(w, r, ps)
+}
+
+func (app *Application) checkoutCartHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.checkoutCartWorker(w, r, ps)
+}
+
+// checkoutCartWorker buys the whole cart at the current catalog prices and
+// reports the items whose price changed since they were put in the cart.
+func (app *Application) checkoutCartWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (err error) {
+	userID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return errors.New("cannot get user id")
+	}
+
+	var receipt *data.Receipt
+	var changes []data.PriceChange
+	err = app.models.Shop.WithTx(r.Context(), func(q *data.Queries) error {
+		receipt, changes, err = q.CheckoutCart(r.Context(), userID)
+		return err
+	})
+	if err != nil {
+		app.cartErrorResponse(w, r, err)
+		return err
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"total": receipt.Total, "items": receipt.Lines, "priceChanges": changes}, nil)
+	return nil
+}
+
+func validateCartQuantity(v *validator.Validator, quantity int) {
+	v.Check(quantity > 0, "quantity", "must be greater than zero")
+	v.Check(quantity <= 1000, "quantity", "must not be more than 1000")
+}
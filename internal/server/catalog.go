@@ -0,0 +1,271 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/wisp167/Shop/internal/data"
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+func (app *Application) listItemsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listItemsWorker(w, r, httprouter.Params{})
+}
+
+func (app *Application) listItemsWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	minPrice := app.readOptionalInt(qs, "min_price", v)
+	maxPrice := app.readOptionalInt(qs, "max_price", v)
+	available := app.readOptionalBool(qs, "available", v)
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "name"),
+		SortSafelist: []string{"name", "price", "-name", "-price"},
+	}
+
+	if minPrice != nil && maxPrice != nil {
+		v.Check(*minPrice <= *maxPrice, "max_price", "must not be less than min_price")
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	items, metadata, err := app.models.Shop.GetAllItems(r.Context(), minPrice, maxPrice, available, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	type listedItem struct {
+		Name        string `json:"name"`
+		Price       int    `json:"price"`
+		Available   bool   `json:"available"`
+		Description string `json:"description"`
+	}
+	response := make([]listedItem, 0, len(items))
+	for _, item := range items {
+		response = append(response, listedItem{
+			Name:        item.Name,
+			Price:       item.Price,
+			Available:   item.Available,
+			Description: item.Description,
+		})
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"items": response, "metadata": metadata}, nil)
+}
+
+func (app *Application) createItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.createItemWorker(w, r, ps)
+}
+
+func (app *Application) createItemWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request struct {
+		Name          string `json:"name"`
+		Price         *int   `json:"price"`
+		Description   string `json:"description"`
+		Stock         *int   `json:"stock"`
+		PurchaseLimit *int   `json:"purchaseLimit"`
+	}
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	v.Check(request.Price != nil, "price", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	item := &data.CatalogItem{
+		Name:          request.Name,
+		Price:         *request.Price,
+		Description:   request.Description,
+		Stock:         request.Stock,
+		PurchaseLimit: request.PurchaseLimit,
+	}
+	if data.ValidateCatalogItem(v, item); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Shop.InsertItem(r.Context(), item)
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateItemName) {
+			v.AddError("name", "an item with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, envelope{"item": item}, nil)
+}
+
+// errInvalidItem rolls back an update which left the item invalid.
+var errInvalidItem = errors.New("invalid item")
+
+func (app *Application) updateItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.updateItemWorker(w, r, ps)
+}
+
+// updateItemWorker changes the name, price, description, stock level or purchase
+// limit of an item. Fields missing from the request are left unchanged, a null
+// stock or purchaseLimit makes the stock unlimited or removes the cap.
+func (app *Application) updateItemWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var request struct {
+		Name          *string     `json:"name"`
+		Price         *int        `json:"price"`
+		Description   *string     `json:"description"`
+		Stock         optionalInt `json:"stock"`
+		PurchaseLimit optionalInt `json:"purchaseLimit"`
+	}
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return
+	}
+
+	// The item is locked while the request's fields are applied, so that
+	// concurrent changes of other fields are not undone
+	var (
+		item *data.CatalogItem
+		v    *validator.Validator
+	)
+	err = app.models.Shop.WithTx(r.Context(), func(q *data.Queries) error {
+		locked, err := q.LockCatalogItem(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		item = locked
+
+		if request.Name != nil {
+			item.Name = *request.Name
+		}
+		if request.Price != nil {
+			item.Price = *request.Price
+		}
+		if request.Description != nil {
+			item.Description = *request.Description
+		}
+		if request.Stock.Set {
+			item.Stock = request.Stock.Value
+		}
+		if request.PurchaseLimit.Set {
+			item.PurchaseLimit = request.PurchaseLimit.Value
+		}
+
+		v = validator.New()
+		if data.ValidateCatalogItem(v, item); !v.Valid() {
+			return errInvalidItem
+		}
+		return q.UpdateItem(r.Context(), item, request.Stock.Set)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidItem):
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateItemName):
+			v := validator.New()
+			v.AddError("name", "an item with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"item": item}, nil)
+}
+
+func (app *Application) archiveItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.setItemArchivedWorker(w, r, true)
+}
+
+func (app *Application) restoreItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.setItemArchivedWorker(w, r, false)
+}
+
+// setItemArchivedWorker takes an item off sale or puts it back. Archived items
+// stay in the inventories of users who already bought them.
+func (app *Application) setItemArchivedWorker(w http.ResponseWriter, r *http.Request, archived bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	item, err := app.models.Shop.SetItemArchived(r.Context(), id, archived)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.notFoundResponse(w, r)
+			return
+		}
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"item": item}, nil)
+}
+
+func (app *Application) restockItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.restockItemWorker(w, r, ps)
+}
+
+func (app *Application) restockItemWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var request struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	v.Check(request.Quantity > 0, "quantity", "must be greater than zero")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	item, err := app.models.Shop.RestockItem(r.Context(), id, request.Quantity)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUnlimitedStock):
+			v.AddError("stock", "item stock is unlimited")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"item": item}, nil)
+}
@@ -1,10 +1,15 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"runtime"
 	"strings"
+	"time"
+
+	"github.com/wisp167/Shop/internal/data"
+	"github.com/wisp167/Shop/internal/validator"
 )
 
 func (app *Application) logError(r *http.Request, err error) {
@@ -36,16 +41,31 @@ func (app *Application) errorResponse(w http.ResponseWriter, r *http.Request, st
 	}
 }
 
+// serverErrorResponse reports an unexpected error. Queries interrupted because
+// the request was cancelled or the database did not answer in time are reported
+// as 503 and 504 respectively.
 func (app *Application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 
-	message := "Внутренняя ошибка сервера."
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	switch {
+	case r.Context().Err() != nil:
+		message := "Сервис временно недоступен."
+		app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+	case data.IsSerializationFailure(err):
+		message := "Сервис перегружен, повторите запрос позже."
+		app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+	case data.IsQueryTimeout(err):
+		message := "Превышено время ожидания базы данных."
+		app.errorResponse(w, r, http.StatusGatewayTimeout, message)
+	default:
+		message := "Внутренняя ошибка сервера."
+		app.errorResponse(w, r, http.StatusInternalServerError, message)
+	}
 }
 
 func (app *Application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusNotFound, message)
 }
 
 func (app *Application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
@@ -66,3 +86,101 @@ func (app *Application) authorizationErrorResponse(w http.ResponseWriter, r *htt
 	message := fmt.Sprintf("Неавторизован.")
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
+
+func (app *Application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("Недостаточно прав.")
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *Application) insufficientFundsResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("Недостаточно монет.")
+	app.errorResponse(w, r, http.StatusBadRequest, message)
+}
+
+// tooManyRequestsResponse rejects a request the server has no capacity for,
+// telling the client when to try again.
+func (app *Application) tooManyRequestsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	message := "Слишком много запросов, повторите позже."
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// loginLockedResponse refuses a login while the username or the client address
+// is throttled after failed attempts.
+func (app *Application) loginLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	message := "Слишком много неудачных попыток входа, повторите позже."
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// purchaseErrorResponse reports why a purchase failed, naming the item at fault.
+func (app *Application) purchaseErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var status int
+	var message string
+	switch {
+	case errors.Is(err, data.ErrInsufficientFunds):
+		app.insufficientFundsResponse(w, r)
+		return
+	case errors.Is(err, data.ErrItemNotFound):
+		status, message = http.StatusBadRequest, "Товар не найден"
+	case errors.Is(err, data.ErrItemArchived):
+		status, message = http.StatusBadRequest, "Товар снят с продажи"
+	case errors.Is(err, data.ErrPurchaseLimitExceeded):
+		status, message = http.StatusBadRequest, "Превышен лимит покупок товара"
+	case errors.Is(err, data.ErrSoldOut):
+		status, message = http.StatusConflict, "Товар распродан"
+	default:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var purchaseErr *data.PurchaseError
+	if errors.As(err, &purchaseErr) {
+		message = fmt.Sprintf("%s: %s.", message, purchaseErr.Item)
+	}
+	app.errorResponse(w, r, status, message)
+}
+
+// cartErrorResponse reports why a cart operation failed.
+func (app *Application) cartErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.notFoundResponse(w, r)
+	case errors.Is(err, data.ErrCartLineTooLarge):
+		v := validator.New()
+		v.AddError("quantity", "must not be more than 1000 in total")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrCartEmpty):
+		message := fmt.Sprintf("Корзина пуста.")
+		app.errorResponse(w, r, http.StatusBadRequest, message)
+	default:
+		app.purchaseErrorResponse(w, r, err)
+	}
+}
+
+// returnErrorResponse reports why units of an order could not be returned.
+func (app *Application) returnErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var message string
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.notFoundResponse(w, r)
+		return
+	case errors.Is(err, data.ErrOrderCancelled):
+		message = "Заказ отменён"
+	case errors.Is(err, data.ErrReturnWindowExpired):
+		message = "Срок возврата истёк"
+	case errors.Is(err, data.ErrItemNotFound):
+		message = "Товара нет в заказе"
+	case errors.Is(err, data.ErrNothingToReturn):
+		message = "Нельзя вернуть больше, чем куплено"
+	default:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var purchaseErr *data.PurchaseError
+	if errors.As(err, &purchaseErr) {
+		message = fmt.Sprintf("%s: %s", message, purchaseErr.Item)
+	}
+	app.errorResponse(w, r, http.StatusBadRequest, message+".")
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"expvar"
 	"net/http"
+
+	"github.com/julienschmidt/httprouter"
 )
 
 func (app *Application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -17,3 +20,8 @@ func (app *Application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// metricsHandler exposes the runtime and application counters published with expvar.
+func (app *Application) metricsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	expvar.Handler().ServeHTTP(w, r)
+}
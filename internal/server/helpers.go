@@ -5,15 +5,35 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/wisp167/Shop/internal/validator"
 )
 
 type envelope map[string]any
 
+// optionalInt is a field of a partial update which may be cleared. Set reports
+// whether the field was present at all, a present null leaves Value nil.
+type optionalInt struct {
+	Set   bool
+	Value *int
+}
+
+func (o *optionalInt) UnmarshalJSON(b []byte) error {
+	o.Set = true
+	if string(b) == "null" {
+		o.Value = nil
+		return nil
+	}
+	return json.Unmarshal(b, &o.Value)
+}
+
 func (app *Application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 	// Decode the request bodt into the target destination
 	maxBytes := 1_048_576
@@ -86,9 +106,85 @@ func (app *Application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+func (app *Application) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	return s
+}
+
+func (app *Application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+	return i
+}
+
+// readOptionalInt returns nil when the parameter is absent.
+func (app *Application) readOptionalInt(qs url.Values, key string, v *validator.Validator) *int {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return nil
+	}
+	return &i
+}
+
+// readOptionalBool returns nil when the parameter is absent.
+func (app *Application) readOptionalBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+	return &b
+}
+
+// readOptionalTime parses an RFC 3339 timestamp, it returns nil when the parameter is absent.
+func (app *Application) readOptionalTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp")
+		return nil
+	}
+	return &t
+}
+
 func wrapHandle(h httprouter.Handle) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		params := httprouter.ParamsFromContext(r.Context())
 		h(w, r, params)
 	}
 }
+
+// clientIP returns the address of the client which sent the request.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/wisp167/Shop/internal/data"
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+func (app *Application) getHistoryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.getHistoryWorker(w, r, ps)
+}
+
+// getHistoryWorker pages through the transfers, purchases and refunds of the
+// user, newest first. The next page is fetched with the cursor of the previous one.
+func (app *Application) getHistoryWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (err error) {
+	userID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return errors.New("cannot get user id")
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filter := data.HistoryFilter{
+		Direction:    app.readString(qs, "direction", ""),
+		Counterparty: app.readString(qs, "counterparty", ""),
+		MinAmount:    app.readOptionalInt(qs, "min_amount", v),
+		MaxAmount:    app.readOptionalInt(qs, "max_amount", v),
+		From:         app.readOptionalTime(qs, "from", v),
+		To:           app.readOptionalTime(qs, "to", v),
+		Limit:        app.readInt(qs, "limit", 20, v),
+	}
+	if cursor := qs.Get("cursor"); cursor != "" {
+		filter.After, err = data.DecodeHistoryCursor(cursor)
+		if err != nil {
+			v.AddError("cursor", "invalid cursor")
+		}
+	}
+
+	if data.ValidateHistoryFilter(v, filter); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return errors.New("invalid request")
+	}
+
+	entries, next, err := app.models.Shop.GetHistory(r.Context(), userID, filter)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return err
+	}
+
+	metadata := envelope{}
+	if next != nil {
+		metadata["next_cursor"] = next.Encode()
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"history": entries, "metadata": metadata}, nil)
+	return nil
+}
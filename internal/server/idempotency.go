@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/wisp167/Shop/internal/data"
+)
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent makes a mutating route safe to retry. A request carrying an
+// Idempotency-Key header runs once, replays with the same key and request get
+// the stored response until the key expires. It must run after jwtMiddleware.
+func (app *Application) idempotent(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r, ps)
+			return
+		}
+		if len(key) > 255 {
+			app.errorResponse(w, r, http.StatusBadRequest, "Idempotency-Key не должен быть длиннее 255 символов.")
+			return
+		}
+
+		userID, ok := r.Context().Value("id").(int64)
+		if !ok {
+			app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.badRequestResponse(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// The key only replays the request it was first used with
+		h := sha256.New()
+		io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+		h.Write(body)
+		fingerprint := h.Sum(nil)
+
+		retention, lease := app.config.idempotencyRetention, app.config.idempotencyLease
+		stored, err := app.models.Shop.ReserveIdempotencyKey(r.Context(), userID, key, fingerprint, retention, lease)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrIdempotencyKeyInUse):
+				app.errorResponse(w, r, http.StatusConflict, "Запрос с этим Idempotency-Key ещё выполняется.")
+			case errors.Is(err, data.ErrIdempotencyKeyMismatch):
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, "Idempotency-Key уже использован для другого запроса.")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if stored != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		// The request may have been cancelled, the key must be settled anyway
+		ctx := context.WithoutCancel(r.Context())
+
+		// A panicking handler rolled its transaction back, free the key
+		// rather than leave it reserved until the lease runs out
+		defer func() {
+			if p := recover(); p != nil {
+				if err := app.models.Shop.ReleaseIdempotencyKey(ctx, userID, key); err != nil {
+					app.logger.Printf("Error releasing idempotency key %q of user %d: %v", key, userID, err)
+				}
+				panic(p)
+			}
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r, ps)
+
+		// Rejected requests never started the operation and leave the key free
+		// for a retry. A server error may come after the transaction committed,
+		// a timeout or a cancelled request among others, so it is stored like
+		// any other response rather than let a retry run the operation again.
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status == http.StatusTooManyRequests {
+			err = app.models.Shop.ReleaseIdempotencyKey(ctx, userID, key)
+		} else {
+			err = app.models.Shop.CompleteIdempotencyKey(ctx, userID, key, &data.IdempotentResponse{
+				Status: rec.status,
+				Body:   rec.body.Bytes(),
+			})
+		}
+		if err != nil {
+			app.logger.Printf("Error settling idempotency key %q of user %d: %v", key, userID, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/wisp167/Shop/internal/data"
+)
+
+// loginThrottle counts the failed logins of every client address in memory.
+type loginThrottle struct {
+	policy data.LoginPolicy
+
+	mu       sync.Mutex
+	failures map[string]*data.LoginFailures
+}
+
+func newLoginThrottle(policy data.LoginPolicy) *loginThrottle {
+	return &loginThrottle{policy: policy, failures: make(map[string]*data.LoginFailures)}
+}
+
+// wait returns how long logins from the address are refused.
+func (t *loginThrottle) wait(ip string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[ip]
+	if !ok {
+		return 0
+	}
+	return t.policy.LockedUntil(f.Failures, f.LastFailedAt).Sub(now)
+}
+
+func (t *loginThrottle) record(ip string, now time.Time) data.LoginFailures {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[ip]
+	if !ok || now.Sub(f.LastFailedAt) > t.policy.Lockout {
+		f = &data.LoginFailures{}
+		t.failures[ip] = f
+	}
+	f.Failures++
+	f.LastFailedAt = now
+	return *f
+}
+
+func (t *loginThrottle) evict(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for ip, f := range t.failures {
+		if now.Sub(f.LastFailedAt) > t.policy.Lockout {
+			delete(t.failures, ip)
+		}
+	}
+}
+
+// loginWait returns how long logins of the username or from the address are
+// refused, whichever is longer.
+func (app *Application) loginWait(ctx context.Context, username, ip string) (time.Duration, error) {
+	now := time.Now()
+	wait := app.loginIPs.wait(ip, now)
+
+	f, err := app.models.Shop.GetLoginFailures(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	if f != nil {
+		if w := app.config.login.policy.LockedUntil(f.Failures, f.LastFailedAt).Sub(now); w > wait {
+			wait = w
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login of the username from the address
+// and logs the lockouts it causes.
+func (app *Application) recordLoginFailure(ctx context.Context, username, ip string) error {
+	ipFailures := app.loginIPs.record(ip, time.Now())
+	if ipFailures.Failures == app.loginIPs.policy.MaxFailures {
+		app.logger.Printf("Logins from %s locked for %s after %d failed attempts", ip, app.loginIPs.policy.Lockout, ipFailures.Failures)
+	}
+
+	policy := app.config.login.policy
+	f, err := app.models.Shop.RecordLoginFailure(ctx, username, policy.Lockout)
+	if err != nil {
+		return err
+	}
+	if f.Failures == policy.MaxFailures {
+		app.logger.Printf("Logins of %q locked for %s after %d failed attempts, last from %s", username, policy.Lockout, f.Failures, ip)
+	}
+	return nil
+}
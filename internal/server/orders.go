@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/wisp167/Shop/internal/data"
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+func (app *Application) listOrdersHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+
+	userID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return
+	}
+	app.listOrdersWorker(w, r, &userID)
+}
+
+func (app *Application) listAllOrdersHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.listOrdersWorker(w, r, nil)
+}
+
+// listOrdersWorker lists the orders of the user, or of every user when userID is nil.
+func (app *Application) listOrdersWorker(w http.ResponseWriter, r *http.Request, userID *int64) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", "")
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "-created_at"),
+		SortSafelist: []string{"created_at", "total", "-created_at", "-total"},
+	}
+
+	if status != "" {
+		v.Check(validator.PermittedValue(status, data.OrderStatuses...), "status", "invalid order status")
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	orders, metadata, err := app.models.Shop.GetOrders(r.Context(), userID, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"orders": orders, "metadata": metadata}, nil)
+}
+
+func (app *Application) updateOrderStatusHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.updateOrderStatusWorker(w, r, ps)
+}
+
+func (app *Application) updateOrderStatusWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (err error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return err
+	}
+
+	var request struct {
+		Status string `json:"status"`
+	}
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return err
+	}
+
+	v := validator.New()
+	v.Check(validator.PermittedValue(request.Status, data.OrderStatuses...), "status", "invalid order status")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return errors.New("invalid request")
+	}
+
+	managerID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return errors.New("cannot get user id")
+	}
+
+	var order *data.Order
+	err = app.models.Shop.WithTx(r.Context(), func(q *data.Queries) error {
+		order, err = q.UpdateOrderStatus(r.Context(), id, request.Status, managerID)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrInvalidStatusTransition):
+			v.AddError("status", "the order cannot be moved to this status")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return err
+	}
+
+	app.logger.Printf("User %d moved order %d to %s", managerID, order.ID, order.Status)
+
+	app.writeJSON(w, http.StatusOK, envelope{"order": order}, nil)
+	return nil
+}
+
+func (app *Application) returnOrderItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.returnOrderItemWorker(w, r, false)
+}
+
+func (app *Application) adminReturnOrderItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.returnOrderItemWorker(w, r, true)
+}
+
+// returnOrderItemWorker returns units of an order and refunds them. Buyers can
+// only return their own orders within the return window, admins can return
+// any order at any time.
+func (app *Application) returnOrderItemWorker(w http.ResponseWriter, r *http.Request, asAdmin bool) (err error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return err
+	}
+
+	var request struct {
+		Item     string `json:"item"`
+		Quantity int    `json:"quantity"`
+	}
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
+		app.badRequestResponse(w, r)
+		return err
+	}
+
+	v := validator.New()
+	v.Check(request.Item != "", "item", "must be provided")
+	v.Check(request.Quantity > 0, "quantity", "must be greater than zero")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return errors.New("invalid request")
+	}
+
+	userID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return errors.New("cannot get user id")
+	}
+
+	req := data.ReturnRequest{
+		OrderID:    id,
+		Item:       request.Item,
+		Quantity:   request.Quantity,
+		Window:     app.config.returnWindow,
+		ReturnedBy: userID,
+	}
+	if !asAdmin {
+		req.BuyerID = &userID
+	}
+
+	var refund *data.Refund
+	err = app.models.Shop.WithTx(r.Context(), func(q *data.Queries) error {
+		refund, err = q.ReturnOrderItem(r.Context(), req)
+		return err
+	})
+	if err != nil {
+		app.returnErrorResponse(w, r, err)
+		return err
+	}
+
+	app.logger.Printf("User %d returned %d x %q of order %d, refunded %d coins", userID, refund.Quantity, refund.Item, refund.OrderID, refund.Amount)
+
+	app.writeJSON(w, http.StatusOK, envelope{"refund": refund}, nil)
+	return nil
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// rateLimit allows requests bursts of up to requests, refilled at requests per
+// period.
+type rateLimit struct {
+	requests int
+	period   time.Duration
+}
+
+func (l rateLimit) String() string {
+	return fmt.Sprintf("%d/%s", l.requests, l.period)
+}
+
+// parseRateLimit parses a limit written as "requests/period", e.g. "10/1m".
+func parseRateLimit(value string) (rateLimit, error) {
+	requests, period, ok := strings.Cut(strings.TrimSpace(value), "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 1 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	return rateLimit{requests: n, period: d}, nil
+}
+
+// parseRateLimits parses per-route limits written as
+// "route=requests/period,route=requests/period".
+func parseRateLimits(value string) (map[string]rateLimit, error) {
+	limits := make(map[string]rateLimit)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		route, limit, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q", pair)
+		}
+		l, err := parseRateLimit(limit)
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(route)] = l
+	}
+	return limits, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client of a route.
+type rateLimiter struct {
+	limit rateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(limit rateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the client's bucket. It returns whether the request
+// is allowed, the tokens left and how long until the bucket is full again, or
+// until the next token when the request is not allowed.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	capacity := float64(l.limit.requests)
+	perToken := l.limit.period / time.Duration(l.limit.requests)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, 0, time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	return true, int(b.tokens), time.Duration((capacity - b.tokens) * float64(perToken))
+}
+
+// evict drops the buckets left untouched for a whole period, they are full
+// again and a new bucket starts full anyway.
+func (l *rateLimiter) evict(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > l.limit.period {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimiter returns the limiter of a route, routes sharing a name share
+// their buckets.
+func (app *Application) rateLimiter(route string) *rateLimiter {
+	limiter, ok := app.rateLimiters[route]
+	if !ok {
+		limit, ok := app.config.rateLimit.limits[route]
+		if !ok {
+			limit = app.config.rateLimit.defaultLimit
+		}
+		limiter = newRateLimiter(limit)
+		app.rateLimiters[route] = limiter
+	}
+	return limiter
+}
+
+// allowRequest takes a token of the client identified by key and sets the
+// X-RateLimit-* headers. A request over the limit is answered with 429 Too
+// Many Requests and false is returned.
+func (app *Application) allowRequest(w http.ResponseWriter, r *http.Request, limiter *rateLimiter, key string) bool {
+	ok, remaining, wait := limiter.allow(key, time.Now())
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.limit.requests))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", retryAfterSeconds(wait))
+
+	if !ok {
+		app.tooManyRequestsResponse(w, r, wait)
+	}
+	return ok
+}
+
+// rateLimitUser limits the requests of every user to an authenticated route. It
+// must run after jwtMiddleware.
+func (app *Application) rateLimitUser(route string, next httprouter.Handle) httprouter.Handle {
+	if !app.config.rateLimit.enabled {
+		return next
+	}
+	limiter := app.rateLimiter(route)
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		userID, ok := r.Context().Value("id").(int64)
+		if !ok {
+			app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+			return
+		}
+		if app.allowRequest(w, r, limiter, "user:"+strconv.FormatInt(userID, 10)) {
+			next(w, r, ps)
+		}
+	}
+}
+
+// rateLimitIP limits the requests of every client address to an
+// unauthenticated route.
+func (app *Application) rateLimitIP(route string, next http.HandlerFunc) http.HandlerFunc {
+	if !app.config.rateLimit.enabled {
+		return next
+	}
+	limiter := app.rateLimiter(route)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.allowRequest(w, r, limiter, "ip:"+clientIP(r)) {
+			next(w, r)
+		}
+	}
+}
+
+// evictClients periodically forgets the clients which stopped sending requests
+// and the failed logins which no longer count.
+func (app *Application) evictClients() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, limiter := range app.rateLimiters {
+				limiter.evict(now)
+			}
+			app.loginIPs.evict(now)
+		case <-app.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter(rateLimit{requests: 2, period: time.Second})
+	now := time.Now()
+
+	for i, want := range []int{1, 0} {
+		ok, remaining, _ := limiter.allow("a", now)
+		if !ok || remaining != want {
+			t.Fatalf("request %d: allowed %v with %d left, want %d left", i, ok, remaining, want)
+		}
+	}
+	ok, _, wait := limiter.allow("a", now)
+	if ok {
+		t.Fatal("request over the limit allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want the time to the next token", wait)
+	}
+
+	// Other clients have their own bucket
+	if ok, _, _ := limiter.allow("b", now); !ok {
+		t.Error("another client's request refused")
+	}
+
+	// A token is back once its share of the period has passed
+	if ok, _, _ := limiter.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("request refused after a token was refilled")
+	}
+}
+
+func TestRateLimitIPExhausted(t *testing.T) {
+	app := newTestApplication()
+	app.config.rateLimit.enabled = true
+	app.config.rateLimit.defaultLimit = rateLimit{requests: 3, period: time.Minute}
+	h := app.rateLimitIP("test", func(w http.ResponseWriter, r *http.Request) {})
+
+	for i := 0; i < 3; i++ {
+		if rec := serve(h); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, rec.Code)
+		}
+	}
+	rec := serve(h)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("X-RateLimit-Remaining = %q, want %q", got, "0")
+	}
+	if got := rec.Header().Get("Retry-After"); got != "20" {
+		t.Errorf("Retry-After = %q, want %q", got, "20")
+	}
+}
+
+func TestRateLimitBeforeAdmission(t *testing.T) {
+	app := newTestApplication()
+	app.config.admission.maxWaiting = 1
+	app.config.admission.waitTimeout = time.Minute
+	app.config.rateLimit.enabled = true
+	app.config.rateLimit.defaultLimit = rateLimit{requests: 1, period: time.Minute}
+	started, release := make(chan struct{}), make(chan struct{})
+	h := app.rateLimitIP("test", app.admit("test", blockingHandler(started, release)))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(h) }()
+	<-started
+	defer func() {
+		close(release)
+		<-done
+	}()
+
+	// Over its limit, the client is turned away without queueing for the
+	// slot it already holds
+	result := make(chan *httptest.ResponseRecorder)
+	go func() { result <- serve(h) }()
+	select {
+	case rec := <-result:
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %d, want 429", rec.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rate limited request queued for admission")
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/wisp167/Shop/internal/data"
+	"github.com/wisp167/Shop/internal/validator"
+)
+
+// ReconcileOptions tells Reconcile whether to correct the balances it finds
+// drifting, the reason code and the admin the corrections are recorded under.
+type ReconcileOptions struct {
+	Fix    bool
+	Reason string
+	Admin  string
+}
+
+// SetupReconcile sets up an Application for the reconcile command. Only the
+// database settings are read, the server is neither configured nor started and
+// no admin is created. Queries run under RECONCILE_TIMEOUT, or -timeout, rather
+// than the per-request timeout as the balances of every user are read at once.
+func SetupReconcile() (*Application, error) {
+	var cfg config
+
+	godotenv.Load(".env")
+
+	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
+
+	ReconcileTimeout, err := getEnvDuration("RECONCILE_TIMEOUT", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerDBFlags(&cfg); err != nil {
+		return nil, err
+	}
+	flag.DurationVar(&cfg.db.queryTimeout, "timeout", ReconcileTimeout, "How long a reconciliation query may run")
+
+	flag.Parse()
+
+	models, err := openModels(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Application{config: cfg, logger: logger, models: models}, nil
+}
+
+// Reconcile recomputes the balance of every user from the ledger and from the
+// history of transfers, refunds and orders, and writes a line to w for every
+// user whose stored balance, ledger and history disagree. With opts.Fix a
+// stored balance drifting from a ledger which agrees with the history is set
+// to the ledger balance. A ledger disagreeing with the history is only
+// reported, the ledger is append-only and needs to be looked into by hand.
+// Reconcile returns how many users are left inconsistent.
+func (app *Application) Reconcile(ctx context.Context, opts ReconcileOptions, w io.Writer) (int, error) {
+	var adminID int64
+	if opts.Fix {
+		v := validator.New()
+		data.ValidateAdjustmentReason(v, opts.Reason)
+		v.Check(opts.Admin != "", "admin", "must be provided")
+		if !v.Valid() {
+			return 0, fmt.Errorf("invalid options: %v", v.Errors)
+		}
+
+		admin, err := app.models.Shop.GetUserByUsername(ctx, opts.Admin)
+		if err != nil {
+			return 0, err
+		}
+		if admin == nil || admin.Role != data.RoleAdmin {
+			return 0, fmt.Errorf("%q is not an admin", opts.Admin)
+		}
+		adminID = admin.ID
+	}
+
+	reports, err := app.models.Shop.GetBalanceReports(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tSTORED\tLEDGER\tHISTORY\tOPENING\tRECEIVED\tSENT\tREFUNDED\tSPENT\tRESULT")
+
+	unresolved := 0
+	for _, report := range reports {
+		if report.Consistent() {
+			continue
+		}
+
+		result := "mismatch"
+		switch {
+		case report.Ledger != report.History:
+			result = "ledger differs from history, not fixed"
+			unresolved++
+		case opts.Fix:
+			// The report stays the one read above when the adjustment failed
+			adjusted, adjustment, err := app.adjustBalance(ctx, report.UserID, opts.Reason, adminID)
+			switch {
+			case err != nil:
+				result = "not fixed: " + err.Error()
+				unresolved++
+			case adjustment == nil:
+				report, result = adjusted, "consistent again"
+			default:
+				report, result = adjusted, "adjusted"
+				app.logger.Printf("Balance of user %q adjusted from %d to %d (%s)", report.Username, adjustment.OldBalance, adjustment.NewBalance, opts.Reason)
+			}
+		default:
+			unresolved++
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", report.Username, report.Stored, report.Ledger, report.History,
+			report.Opening, report.Received, report.Sent, report.Refunded, report.Spent, result)
+	}
+	if err := tw.Flush(); err != nil {
+		return unresolved, err
+	}
+
+	fmt.Fprintf(w, "%d users checked, %d inconsistent\n", len(reports), unresolved)
+	return unresolved, nil
+}
+
+var errBalanceChanged = errors.New("balance no longer drifts from the ledger alone")
+
+// adjustBalance sets the stored balance of a user to the ledger balance. The
+// balance is recomputed once the user is locked, as it may have moved since
+// it was reported. It returns the report read before the adjustment and the
+// adjustment, nil when the balance needed none anymore.
+func (app *Application) adjustBalance(ctx context.Context, userID int64, reason string, adminID int64) (*data.BalanceReport, *data.BalanceAdjustment, error) {
+	var (
+		report     *data.BalanceReport
+		adjustment *data.BalanceAdjustment
+	)
+	err := app.models.Shop.WithTx(ctx, func(q *data.Queries) error {
+		adjustment = nil
+		if _, err := q.LockUsers(ctx, userID); err != nil {
+			return err
+		}
+		reports, err := q.GetBalanceReports(ctx, &userID)
+		if err != nil {
+			return err
+		}
+		if len(reports) != 1 {
+			return data.ErrRecordNotFound
+		}
+		report = reports[0]
+		if report.Ledger != report.History {
+			return errBalanceChanged
+		}
+		if report.Stored == report.Ledger {
+			return nil
+		}
+
+		adjustment, err = q.AdjustBalance(ctx, userID, report.Stored, report.Ledger, reason, adminID)
+		return err
+	})
+	return report, adjustment, err
+}
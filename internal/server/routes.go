@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/wisp167/Shop/internal/data"
 )
 
 func (app *Application) routes() *httprouter.Router {
@@ -13,9 +14,40 @@ func (app *Application) routes() *httprouter.Router {
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthz", app.healthcheckHandler) //health
-	router.HandlerFunc(http.MethodPost, "/api/auth", app.authHandler)
-	router.HandlerFunc(http.MethodGet, "/api/buy/:item", app.jwtMiddleware(app.buyItemHandler))
-	router.HandlerFunc(http.MethodPost, "/api/sendCoin", app.jwtMiddleware(app.sendCoinHandler))
-	router.HandlerFunc(http.MethodGet, "/api/info", app.jwtMiddleware(app.getInfoHandler))
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.jwtMiddleware(app.requireRole(app.metricsHandler, data.RoleAdmin)))
+	router.HandlerFunc(http.MethodPost, "/api/auth", app.rateLimitIP("auth", app.admit("auth", app.authHandler)))
+	router.HandlerFunc(http.MethodPost, "/api/register", app.rateLimitIP("register", app.admit("register", app.registerHandler)))
+	router.HandlerFunc(http.MethodPost, "/api/auth/refresh", app.rateLimitIP("refresh", app.admit("refresh", app.refreshHandler)))
+	router.HandlerFunc(http.MethodPost, "/api/auth/logout", app.jwtMiddleware(app.rateLimitUser("logout", app.admitHandle("logout", app.logoutHandler))))
+	router.HandlerFunc(http.MethodGet, "/api/buy/:item", app.jwtMiddleware(app.rateLimitUser("buy", app.admitHandle("buy", app.idempotent(app.buyItemHandler)))))
+	router.HandlerFunc(http.MethodPost, "/api/checkout", app.jwtMiddleware(app.rateLimitUser("checkout", app.admitHandle("checkout", app.idempotent(app.checkoutHandler)))))
+	router.HandlerFunc(http.MethodGet, "/api/orders", app.jwtMiddleware(app.rateLimitUser("orders", app.admitHandle("orders", app.listOrdersHandler))))
+	router.HandlerFunc(http.MethodPost, "/api/orders/:id/return", app.jwtMiddleware(app.rateLimitUser("returnOrder", app.admitHandle("returnOrder", app.idempotent(app.returnOrderItemHandler)))))
+	router.HandlerFunc(http.MethodGet, "/api/cart", app.jwtMiddleware(app.rateLimitUser("cart", app.admitHandle("cart", app.getCartHandler))))
+	router.HandlerFunc(http.MethodPost, "/api/cart/items", app.jwtMiddleware(app.rateLimitUser("cart", app.admitHandle("cart", app.addCartItemHandler))))
+	router.HandlerFunc(http.MethodPut, "/api/cart/items/:item", app.jwtMiddleware(app.rateLimitUser("cart", app.admitHandle("cart", app.updateCartItemHandler))))
+	router.HandlerFunc(http.MethodDelete, "/api/cart/items/:item", app.jwtMiddleware(app.rateLimitUser("cart", app.admitHandle("cart", app.removeCartItemHandler))))
+	router.HandlerFunc(http.MethodPost, "/api/cart/checkout", app.jwtMiddleware(app.rateLimitUser("checkout", app.admitHandle("checkout", app.idempotent(app.checkoutCartHandler)))))
+	router.HandlerFunc(http.MethodPost, "/api/sendCoin", app.jwtMiddleware(app.rateLimitUser("sendCoin", app.admitHandle("sendCoin", app.idempotent(app.sendCoinHandler)))))
+	router.HandlerFunc(http.MethodGet, "/api/info", app.jwtMiddleware(app.rateLimitUser("info", app.admitHandle("info", app.getInfoHandler))))
+	router.HandlerFunc(http.MethodGet, "/api/history", app.jwtMiddleware(app.rateLimitUser("history", app.admitHandle("history", app.getHistoryHandler))))
+	router.HandlerFunc(http.MethodGet, "/api/items", app.rateLimitIP("items", app.admit("items", app.listItemsHandler)))
+
+	router.HandlerFunc(http.MethodPut, "/api/admin/users/:username/role", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.setUserRoleHandler, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodPost, "/api/admin/users/:username/revoke", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.revokeUserSessionsHandler, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodPost, "/api/admin/users/:username/unlock", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.unlockLoginHandler, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodGet, "/api/admin/users/:username/balance", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.checkBalanceHandler, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodPost, "/api/admin/mint", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.idempotent(app.mintCoinsHandler), data.RoleAdmin)))))
+
+	router.HandlerFunc(http.MethodPost, "/api/admin/items", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.createItemHandler, data.RoleShopManager, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodPatch, "/api/admin/items/:id", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.updateItemHandler, data.RoleShopManager, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodPost, "/api/admin/items/:id/archive", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.archiveItemHandler, data.RoleShopManager, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodPost, "/api/admin/items/:id/restore", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.restoreItemHandler, data.RoleShopManager, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodPost, "/api/admin/items/:id/restock", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.restockItemHandler, data.RoleShopManager, data.RoleAdmin)))))
+
+	router.HandlerFunc(http.MethodGet, "/api/admin/orders", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.listAllOrdersHandler, data.RoleShopManager, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodPut, "/api/admin/orders/:id/status", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.updateOrderStatusHandler, data.RoleShopManager, data.RoleAdmin)))))
+	router.HandlerFunc(http.MethodPost, "/api/admin/orders/:id/return", app.jwtMiddleware(app.rateLimitUser("admin", app.admitHandle("admin", app.requireRole(app.adminReturnOrderItemHandler, data.RoleAdmin)))))
+
 	return router
 }
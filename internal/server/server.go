@@ -14,15 +14,43 @@ import (
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/wisp167/Shop/internal/data"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const version = "1.0.0"
 
 type config struct {
-	port       int
-	env        string
-	numWorkers int
-	db         struct {
+	port            int
+	env             string
+	bcryptCost      int
+	autoRegister    bool
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	returnWindow    time.Duration
+	// idempotencyRetention is how long responses are kept for Idempotency-Key replays
+	idempotencyRetention time.Duration
+	// idempotencyLease is how long a request holds its Idempotency-Key before a retry may take it over
+	idempotencyLease time.Duration
+	admission        struct {
+		maxConcurrent int
+		maxWaiting    int
+		waitTimeout   time.Duration
+		limits        map[string]int
+	}
+	rateLimit struct {
+		enabled      bool
+		defaultLimit rateLimit
+		limits       map[string]rateLimit
+	}
+	login struct {
+		policy        data.LoginPolicy
+		ipMaxFailures int
+	}
+	admin struct {
+		username string
+		password string
+	}
+	db struct {
 		dsn          string
 		host         string
 		name         string
@@ -31,21 +59,27 @@ type config struct {
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		queryTimeout time.Duration
+		txIsolation  string
+		txAttempts   int
 	}
 }
 
 type Application struct {
-	config config
-	logger *log.Logger
-	models data.Models
-	queue  chan struct{}
-	jwtkey []byte
-	server *http.Server
+	config   config
+	logger   *log.Logger
+	models   data.Models
+	limiters map[string]*admissionLimiter
+	// rateLimiters is filled while the routes are built and only read afterwards.
+	rateLimiters map[string]*rateLimiter
+	loginIPs     *loginThrottle
+	jwtkey       []byte
+	server       *http.Server
+	done         chan struct{}
 }
 
 func SetupApplication() (*Application, error) {
 	var cfg config
-	var jwtkey string
 
 	godotenv.Load(".env")
 
@@ -56,13 +90,73 @@ func SetupApplication() (*Application, error) {
 		return nil, fmt.Errorf("failed to parse PORT: %v", err)
 	}
 
-	DbMaxOpenCons, err := strconv.Atoi(os.Getenv("DATABASE_MAX_OPEN_CONNS"))
+	BcryptCost, err := getEnvInt("BCRYPT_COST", bcrypt.DefaultCost)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse DATABASE_MAX_OPEN_CONNS: %v", err)
+		return nil, err
 	}
-	DbMaxIdleCons, err := strconv.Atoi(os.Getenv("DATABASE_MAX_IDLE_CONNS"))
+	AutoRegister, err := getEnvBool("AUTO_REGISTER", true)
+	if err != nil {
+		return nil, err
+	}
+	AccessTokenTTL, err := getEnvDuration("ACCESS_TOKEN_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	RefreshTokenTTL, err := getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	DbQueryTimeout, err := getEnvDuration("DATABASE_QUERY_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	ReturnWindow, err := getEnvDuration("RETURN_WINDOW", 14*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	AdmissionMaxConcurrent, err := getEnvInt("ADMISSION_MAX_CONCURRENT", 50)
+	if err != nil {
+		return nil, err
+	}
+	AdmissionMaxWaiting, err := getEnvInt("ADMISSION_MAX_WAITING", 1000)
+	if err != nil {
+		return nil, err
+	}
+	AdmissionWaitTimeout, err := getEnvDuration("ADMISSION_WAIT_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	RateLimitEnabled, err := getEnvBool("RATE_LIMIT_ENABLED", true)
+	if err != nil {
+		return nil, err
+	}
+	RateLimitDefault := os.Getenv("RATE_LIMIT_DEFAULT")
+	if RateLimitDefault == "" {
+		RateLimitDefault = "100/1s"
+	}
+	LoginMaxFailures, err := getEnvInt("LOGIN_MAX_FAILURES", 6)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse DATABASE_MAX_IDLE_CONNS: %v", err)
+		return nil, err
+	}
+	LoginIPMaxFailures, err := getEnvInt("LOGIN_IP_MAX_FAILURES", 30)
+	if err != nil {
+		return nil, err
+	}
+	LoginDelay, err := getEnvDuration("LOGIN_DELAY", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	LoginLockout, err := getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	IdempotencyRetention, err := getEnvDuration("IDEMPOTENCY_RETENTION", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	IdempotencyLease, err := getEnvDuration("IDEMPOTENCY_LEASE", time.Minute)
+	if err != nil {
+		return nil, err
 	}
 	jwtKey := os.Getenv("JWT_KEY")
 	if jwtKey == "" {
@@ -70,6 +164,118 @@ func SetupApplication() (*Application, error) {
 	}
 	flag.IntVar(&cfg.port, "port", EnvPort, "API server port")
 	flag.StringVar(&cfg.env, "env", os.Getenv("ENV"), "Environment (development|staging|production)")
+	flag.IntVar(&cfg.bcryptCost, "bcrypt-cost", BcryptCost, "bcrypt cost used to hash passwords")
+	flag.BoolVar(&cfg.autoRegister, "auto-register", AutoRegister, "Create an account on the first login of an unknown user")
+	flag.DurationVar(&cfg.accessTokenTTL, "access-token-ttl", AccessTokenTTL, "Lifetime of issued access tokens")
+	flag.DurationVar(&cfg.refreshTokenTTL, "refresh-token-ttl", RefreshTokenTTL, "Lifetime of issued refresh tokens")
+	flag.DurationVar(&cfg.returnWindow, "return-window", ReturnWindow, "How long after a purchase the buyer may return it")
+	flag.DurationVar(&cfg.idempotencyRetention, "idempotency-retention", IdempotencyRetention, "How long responses are replayed for a reused Idempotency-Key")
+	flag.DurationVar(&cfg.idempotencyLease, "idempotency-lease", IdempotencyLease, "How long an Idempotency-Key stays reserved for a request which did not finish")
+	flag.IntVar(&cfg.admission.maxConcurrent, "admission-max-concurrent", AdmissionMaxConcurrent, "Requests of an endpoint handled at once")
+	flag.IntVar(&cfg.admission.maxWaiting, "admission-max-waiting", AdmissionMaxWaiting, "Requests of an endpoint waiting for a free slot")
+	flag.DurationVar(&cfg.admission.waitTimeout, "admission-wait-timeout", AdmissionWaitTimeout, "How long a request waits for a free slot before 429")
+	admissionLimits := flag.String("admission-limits", os.Getenv("ADMISSION_LIMITS"), "Per-endpoint concurrency limits (endpoint=limit,...)")
+	flag.BoolVar(&cfg.rateLimit.enabled, "rate-limit-enabled", RateLimitEnabled, "Rate limit requests per user and per client IP")
+	rateLimitDefault := flag.String("rate-limit-default", RateLimitDefault, "Rate limit of the routes without their own (requests/period)")
+	rateLimits := flag.String("rate-limits", os.Getenv("RATE_LIMITS"), "Per-route rate limits (route=requests/period,...)")
+	flag.IntVar(&cfg.login.policy.MaxFailures, "login-max-failures", LoginMaxFailures, "Failed logins of a username before it is locked")
+	flag.IntVar(&cfg.login.ipMaxFailures, "login-ip-max-failures", LoginIPMaxFailures, "Failed logins from a client IP before it is locked")
+	flag.DurationVar(&cfg.login.policy.Delay, "login-delay", LoginDelay, "First delay imposed after repeated failed logins, doubled on every failure")
+	flag.DurationVar(&cfg.login.policy.Lockout, "login-lockout", LoginLockout, "How long logins stay locked after too many failures")
+	flag.StringVar(&cfg.admin.username, "admin-username", os.Getenv("ADMIN_USERNAME"), "Username of the admin account created on startup")
+	flag.StringVar(&cfg.admin.password, "admin-password", os.Getenv("ADMIN_PASSWORD"), "Password of the admin account created on startup")
+
+	if err := registerDBFlags(&cfg); err != nil {
+		return nil, err
+	}
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", DbQueryTimeout, "PostgreSQL query timeout")
+
+	flag.Parse()
+
+	cfg.admission.limits, err = parseAdmissionLimits(*admissionLimits)
+	if err != nil {
+		return nil, err
+	}
+	cfg.rateLimit.defaultLimit, err = parseRateLimit(*rateLimitDefault)
+	if err != nil {
+		return nil, err
+	}
+	cfg.rateLimit.limits, err = parseRateLimits(*rateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.bcryptCost < bcrypt.MinCost || cfg.bcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if cfg.admission.maxConcurrent < 1 || cfg.admission.maxWaiting < 0 || cfg.admission.waitTimeout < 0 {
+		return nil, fmt.Errorf("invalid admission settings")
+	}
+	if cfg.login.policy.MaxFailures < 1 || cfg.login.ipMaxFailures < 1 || cfg.login.policy.Delay <= 0 || cfg.login.policy.Lockout <= 0 {
+		return nil, fmt.Errorf("invalid login throttling settings")
+	}
+	if cfg.idempotencyRetention <= 0 {
+		return nil, fmt.Errorf("idempotency retention must be positive")
+	}
+	if cfg.idempotencyLease <= 0 || cfg.idempotencyLease > cfg.idempotencyRetention {
+		return nil, fmt.Errorf("idempotency lease must be positive and within the retention")
+	}
+	if cfg.returnWindow < 0 {
+		return nil, fmt.Errorf("return window must not be negative")
+	}
+	if cfg.admin.username != "" && cfg.admin.password == "" {
+		return nil, fmt.Errorf("ADMIN_PASSWORD is required when ADMIN_USERNAME is set")
+	}
+
+	models, err := openModels(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("Config: %v", cfg)
+
+	app := &Application{
+		config:       cfg,
+		logger:       logger,
+		models:       models,
+		limiters:     make(map[string]*admissionLimiter),
+		rateLimiters: make(map[string]*rateLimiter),
+		loginIPs: newLoginThrottle(data.LoginPolicy{
+			MaxFailures: cfg.login.ipMaxFailures,
+			Delay:       cfg.login.policy.Delay,
+			Lockout:     cfg.login.policy.Lockout,
+		}),
+		jwtkey: []byte(jwtKey),
+		done:   make(chan struct{}),
+	}
+
+	if err := app.bootstrapAdmin(); err != nil {
+		return nil, fmt.Errorf("failed to bootstrap admin: %v", err)
+	}
+
+	return app, nil
+}
+
+// registerDBFlags reads the database settings from the environment and
+// registers the flags overriding them, except for the query timeout which
+// depends on the command.
+func registerDBFlags(cfg *config) error {
+	DbMaxOpenCons, err := strconv.Atoi(os.Getenv("DATABASE_MAX_OPEN_CONNS"))
+	if err != nil {
+		return fmt.Errorf("failed to parse DATABASE_MAX_OPEN_CONNS: %v", err)
+	}
+	DbMaxIdleCons, err := strconv.Atoi(os.Getenv("DATABASE_MAX_IDLE_CONNS"))
+	if err != nil {
+		return fmt.Errorf("failed to parse DATABASE_MAX_IDLE_CONNS: %v", err)
+	}
+	DbTxAttempts, err := getEnvInt("DATABASE_TX_MAX_ATTEMPTS", 5)
+	if err != nil {
+		return err
+	}
+	DbTxIsolation := os.Getenv("DATABASE_TX_ISOLATION")
+	if DbTxIsolation == "" {
+		DbTxIsolation = "read-committed"
+	}
 
 	flag.StringVar(&cfg.db.host, "db-host", os.Getenv("DATABASE_HOST"), "PostgreSQL host")
 	flag.StringVar(&cfg.db.name, "db-name", os.Getenv("DATABASE_NAME"), "PostgreSQL database name")
@@ -79,33 +285,89 @@ func SetupApplication() (*Application, error) {
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", DbMaxOpenCons, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", DbMaxIdleCons, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", os.Getenv("DATABASE_MAX_IDLE_TIME"), "PostgreSQL max connection idle time")
+	flag.StringVar(&cfg.db.txIsolation, "db-tx-isolation", DbTxIsolation, "PostgreSQL transaction isolation (read-committed|repeatable-read|serializable)")
+	flag.IntVar(&cfg.db.txAttempts, "db-tx-max-attempts", DbTxAttempts, "How many times a transaction failing with a serialization error is run")
+	return nil
+}
 
-	cfg.numWorkers = 50
+// openModels validates the database settings and opens the database.
+func openModels(cfg config) (data.Models, error) {
+	if cfg.db.queryTimeout <= 0 {
+		return data.Models{}, fmt.Errorf("database query timeout must be positive")
+	}
+	txIsolation, ok := txIsolationLevels[cfg.db.txIsolation]
+	if !ok {
+		return data.Models{}, fmt.Errorf("unknown transaction isolation %q", cfg.db.txIsolation)
+	}
+	if cfg.db.txAttempts < 1 {
+		return data.Models{}, fmt.Errorf("transaction max attempts must be at least 1")
+	}
 
-	flag.Parse()
+	db, err := OpenDB(cfg)
+	if err != nil {
+		return data.Models{}, fmt.Errorf("failed to open database: %v", err)
+	}
+	return data.NewModels(db, data.Config{
+		QueryTimeout:  cfg.db.queryTimeout,
+		TxIsolation:   txIsolation,
+		TxMaxAttempts: cfg.db.txAttempts,
+	}), nil
+}
 
-	logger.Printf("Config: %v", cfg)
+var txIsolationLevels = map[string]sql.IsolationLevel{
+	"read-committed":  sql.LevelReadCommitted,
+	"repeatable-read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
 
-	// Open the database connection
-	db, err := OpenDB(cfg)
+// getEnvInt parses an optional integer environment variable.
+func getEnvInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(value)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return 0, fmt.Errorf("failed to parse %s: %v", key, err)
 	}
+	return i, nil
+}
 
-	app := &Application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		jwtkey: []byte(jwtkey),
-		queue:  make(chan struct{}, cfg.numWorkers),
+// getEnvBool parses an optional boolean environment variable.
+func getEnvBool(key string, fallback bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
 	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s: %v", key, err)
+	}
+	return b, nil
+}
 
-	return app, nil
+// getEnvDuration parses an optional duration environment variable.
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %v", key, err)
+	}
+	return d, nil
 }
+
 func (app *Application) Start() error {
+	router := app.routes()
+	if err := app.checkAdmissionLimits(); err != nil {
+		return err
+	}
+
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
-		Handler:      app.routes(),
+		Handler:      router,
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
@@ -121,6 +383,9 @@ func (app *Application) Start() error {
 		}
 	}()
 
+	go app.cleanupExpired()
+	go app.evictClients()
+
 	return nil
 }
 
@@ -128,6 +393,7 @@ func (app *Application) Stop() error {
 	if app.server == nil {
 		return nil
 	}
+	close(app.done)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -4,16 +4,14 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/wisp167/Shop/internal/data"
+	"github.com/wisp167/Shop/internal/validator"
 )
 
 func (app *Application) buyItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	app.queue <- struct{}{}
-	defer func() {
-		<-app.queue
-	}()
 	app.buyItemWorker(w, r, ps)
 }
 
@@ -29,63 +27,61 @@ func (app *Application) buyItemWorker(w http.ResponseWriter, r *http.Request, ps
 		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
 		return nil
 	}
-	tx, err := app.models.Shop.DB.BeginTx(context.Background(), nil)
+	err = app.models.Shop.WithTx(r.Context(), func(q *data.Queries) error {
+		_, err := q.Purchase(r.Context(), userID, []data.PurchaseLine{{Item: itemName, Quantity: 1}})
+		return err
+	})
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.purchaseErrorResponse(w, r, err)
 		return err
 	}
+	app.writeJSON(w, http.StatusOK, envelope{}, nil)
+	return nil
+}
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
+func (app *Application) checkoutHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	app.checkoutWorker(w, r, ps)
+}
 
-	item, err := app.models.Shop.GetItemByName(itemName)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return err
+// checkoutWorker buys a cart of items in a single transaction, the total is
+// debited once and nothing is bought if any line fails.
+func (app *Application) checkoutWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (err error) {
+	var request struct {
+		Items []data.PurchaseLine `json:"items"`
 	}
-	if item == nil {
+	if err := app.readJSON(w, r, &request); err != nil {
+		app.logger.Printf("Error reading JSON: %v", err)
 		app.badRequestResponse(w, r)
-		err = errors.New("item not found")
 		return err
 	}
-	user, err := app.models.Shop.GetUserByID(userID)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return err
+
+	v := validator.New()
+	if data.ValidatePurchaseLines(v, request.Items); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return errors.New("invalid request")
 	}
-	if user.Balance < item.Price {
-		app.badRequestResponse(w, r)
-		err = errors.New("")
-		return err
+
+	userID, ok := r.Context().Value("id").(int64)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("cannot get user id"))
+		return errors.New("cannot get user id")
 	}
-	err = app.models.Shop.UpdateUserBalanceAfterPurchase(tx, userID, item.Price)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		err = errors.New("")
+
+	var receipt *data.Receipt
+	err = app.models.Shop.WithTx(r.Context(), func(q *data.Queries) error {
+		receipt, err = q.Purchase(r.Context(), userID, request.Items)
 		return err
-	}
-	err = app.models.Shop.InsertUserItem(tx, userID, item.ID)
+	})
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.purchaseErrorResponse(w, r, err)
 		return err
 	}
-	err = tx.Commit()
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return err
-	}
-	app.writeJSON(w, http.StatusOK, envelope{}, nil)
+
+	app.writeJSON(w, http.StatusOK, receipt, nil)
 	return nil
 }
 
 func (app *Application) sendCoinHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	app.queue <- struct{}{}
-	defer func() {
-		<-app.queue
-	}()
 	app.sendCoinWorker(w, r, httprouter.Params{})
 }
 func (app *Application) sendCoinWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (err error) {
@@ -115,79 +111,71 @@ func (app *Application) sendCoinWorker(w http.ResponseWriter, r *http.Request, p
 		return errors.New("cannot get user id")
 	}
 
-	// Start a database transaction
-	tx, err := app.models.Shop.DB.BeginTx(context.Background(), nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return err
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
-
-	// Get the sender's details
-	sender, err := app.models.Shop.GetUserByID(userID)
+	// Get the receiver's details
+	receiver, err := app.models.Shop.GetUserByUsername(r.Context(), request.Receiver)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return err
 	}
-
-	// Validate sender's balance and receiver
-	if sender.Balance < request.Amount || sender.Username == request.Receiver {
+	if receiver == nil || receiver.ID == userID {
 		app.badRequestResponse(w, r)
-		return errors.New("insufficient balance or invalid receiver")
+		return errors.New("receiver not found or invalid")
 	}
 
-	// Update sender's balance
-	if err := app.models.Shop.UpdateSenderBalance(tx, userID, request.Amount); err != nil {
-		app.serverErrorResponse(w, r, err)
-		return err
-	}
+	// Transfer the coins in a single transaction
+	var transfer *data.Transfer
+	err = app.models.Shop.WithTx(r.Context(), func(q *data.Queries) error {
+		// Lock both users so the balance can't change before it is debited
+		balances, err := q.LockUsers(r.Context(), userID, receiver.ID)
+		if err != nil {
+			return err
+		}
 
-	// Get the receiver's details
-	receiver, err := app.models.Shop.GetUserByUsername(request.Receiver)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return err
-	}
-	if receiver == nil {
-		app.badRequestResponse(w, r)
-		return errors.New("receiver not found")
-	}
+		// Validate sender's balance
+		if balances[userID] < request.Amount {
+			return data.ErrInsufficientFunds
+		}
 
-	// Update receiver's balance
-	if err := app.models.Shop.UpdateReceiverBalance(tx, receiver.ID, request.Amount); err != nil {
-		app.serverErrorResponse(w, r, err)
-		return err
-	}
+		// Update sender's balance
+		if err := q.UpdateSenderBalance(r.Context(), userID, request.Amount); err != nil {
+			return err
+		}
 
-	// Record the transaction
-	if err := app.models.Shop.InsertTransaction(tx, sender.ID, receiver.ID, request.Amount); err != nil {
-		app.serverErrorResponse(w, r, err)
-		return err
-	}
+		// Update receiver's balance
+		if err := q.UpdateReceiverBalance(r.Context(), receiver.ID, request.Amount); err != nil {
+			return err
+		}
 
-	// Commit the transaction
-	if err := tx.Commit(); err != nil {
+		// Record the transaction
+		transfer, err = q.InsertTransaction(r.Context(), userID, receiver.ID, request.Amount)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, data.ErrInsufficientFunds) {
+			app.insufficientFundsResponse(w, r)
+			return err
+		}
 		app.serverErrorResponse(w, r, err)
 		return err
 	}
 
 	// Return a success response
-	app.writeJSON(w, http.StatusOK, envelope{}, nil)
+	transfer.ToUser = receiver.Username
+	app.writeJSON(w, http.StatusOK, envelope{"transfer": transfer}, nil)
 	return nil
 }
 
 func (app *Application) getInfoHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	app.queue <- struct{}{}
-	defer func() {
-		<-app.queue
-	}()
 	app.getInfoWorker(w, r, ps)
 }
 
+// infoHistoryLimit bounds the lists of /api/info, the whole history is paged
+// through /api/history.
+const infoHistoryLimit = 20
+
+// getInfoWorker returns the balance, inventory and recent coin history of the
+// user. Transfers are grouped by counterparty unless the itemised history is
+// asked for with ?history=itemised.
 func (app *Application) getInfoWorker(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (err error) {
 	// Get the user ID from the context
 	userID, ok := r.Context().Value("id").(int64)
@@ -196,15 +184,29 @@ func (app *Application) getInfoWorker(w http.ResponseWriter, r *http.Request, ps
 		return errors.New("cannot get user id")
 	}
 
+	v := validator.New()
+	view := app.readString(r.URL.Query(), "history", "grouped")
+	if v.Check(validator.PermittedValue(view, "grouped", "itemised"), "history", "must be grouped or itemised"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return errors.New("invalid request")
+	}
+
 	// Fetch user balance and inventory
-	balance, inventory, err := app.models.Shop.GetUserBalanceAndInventory(userID)
+	balance, inventory, err := app.models.Shop.GetUserBalanceAndInventory(r.Context(), userID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return err
 	}
 
-	// Fetch transaction history with usernames
-	transactions, err := app.models.Shop.GetTransactionHistoryWithUsernames(userID)
+	// Fetch the refunds of returned items
+	refunds, err := app.models.Shop.GetRefunds(r.Context(), userID, infoHistoryLimit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return err
+	}
+
+	// Fetch the items bought
+	purchases, err := app.models.Shop.GetPurchases(r.Context(), userID, infoHistoryLimit)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return err
@@ -215,46 +217,107 @@ func (app *Application) getInfoWorker(w http.ResponseWriter, r *http.Request, ps
 		Coins       int         `json:"coins"`
 		Inventory   []data.Item `json:"inventory"`
 		CoinHistory struct {
-			Received []struct {
-				FromUser string `json:"fromUser"`
-				Amount   int    `json:"amount"`
-			} `json:"received"`
-			Sent []struct {
-				ToUser string `json:"toUser"`
-				Amount int    `json:"amount"`
-			} `json:"sent"`
+			Received  any                 `json:"received"`
+			Sent      any                 `json:"sent"`
+			Purchases []*data.WalletEntry `json:"purchases"`
+			Refunds   []*data.Refund      `json:"refunds"`
 		} `json:"coinHistory"`
 	}{
 		Coins:     balance,
 		Inventory: inventory,
 	}
+	response.CoinHistory.Purchases = purchases
+	response.CoinHistory.Refunds = refunds
 
-	// Populate the coin history
+	if view == "itemised" {
+		response.CoinHistory.Received, response.CoinHistory.Sent, err = app.itemisedTransfers(r.Context(), userID)
+	} else {
+		response.CoinHistory.Received, response.CoinHistory.Sent, err = app.groupedTransfers(r.Context(), userID)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return err
+	}
+
+	// Return the response
+	app.writeJSON(w, http.StatusOK, response, nil)
+	return nil
+}
+
+// groupedTransfers sums the transfers of the user per counterparty, keeping the
+// largest ones.
+func (app *Application) groupedTransfers(ctx context.Context, userID int64) (any, any, error) {
+	type receivedTotal struct {
+		FromUser       string    `json:"fromUser"`
+		Amount         int       `json:"amount"`
+		Count          int       `json:"count"`
+		LastTransferAt time.Time `json:"lastTransferAt"`
+	}
+	type sentTotal struct {
+		ToUser         string    `json:"toUser"`
+		Amount         int       `json:"amount"`
+		Count          int       `json:"count"`
+		LastTransferAt time.Time `json:"lastTransferAt"`
+	}
+
+	receivedTotals, sentTotals, err := app.models.Shop.GetTransferTotals(ctx, userID, infoHistoryLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	received := make([]receivedTotal, 0, len(receivedTotals))
+	for _, t := range receivedTotals {
+		received = append(received, receivedTotal{FromUser: t.User, Amount: t.Amount, Count: t.Count, LastTransferAt: t.LastTransferAt})
+	}
+	sent := make([]sentTotal, 0, len(sentTotals))
+	for _, t := range sentTotals {
+		sent = append(sent, sentTotal{ToUser: t.User, Amount: t.Amount, Count: t.Count, LastTransferAt: t.LastTransferAt})
+	}
+	return received, sent, nil
+}
+
+// itemisedTransfers lists the latest transfers of the user, newest first.
+func (app *Application) itemisedTransfers(ctx context.Context, userID int64) (any, any, error) {
+	type receivedEntry struct {
+		ID        string    `json:"id"`
+		FromUser  string    `json:"fromUser"`
+		Amount    int       `json:"amount"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+	type sentEntry struct {
+		ID        string    `json:"id"`
+		ToUser    string    `json:"toUser"`
+		Amount    int       `json:"amount"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	// Fetch transaction history with usernames
+	transactions, err := app.models.Shop.GetTransactionHistoryWithUsernames(ctx, userID, infoHistoryLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	received, sent := []receivedEntry{}, []sentEntry{}
 	for _, t := range transactions {
 		if t.ToUserID == userID {
 			// Received transaction
-			response.CoinHistory.Received = append(response.CoinHistory.Received, struct {
-				FromUser string `json:"fromUser"`
-				Amount   int    `json:"amount"`
-			}{
-				FromUser: t.FromUser,
-				Amount:   t.Amount,
+			received = append(received, receivedEntry{
+				ID:        t.PublicID,
+				FromUser:  t.FromUser,
+				Amount:    t.Amount,
+				CreatedAt: t.CreatedAt,
 			})
 		} else if t.FromUserID == userID {
 			// Sent transaction
-			response.CoinHistory.Sent = append(response.CoinHistory.Sent, struct {
-				ToUser string `json:"toUser"`
-				Amount int    `json:"amount"`
-			}{
-				ToUser: t.ToUser,
-				Amount: t.Amount,
+			sent = append(sent, sentEntry{
+				ID:        t.PublicID,
+				ToUser:    t.ToUser,
+				Amount:    t.Amount,
+				CreatedAt: t.CreatedAt,
 			})
 		}
 	}
-
-	// Return the response
-	app.writeJSON(w, http.StatusOK, response, nil)
-	return nil
+	return received, sent, nil
 }
 
 /*
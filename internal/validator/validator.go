@@ -3,7 +3,10 @@ package validator
 import "regexp"
 
 var (
-	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+	EmailRX    = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+	UsernameRX = regexp.MustCompile("^[a-zA-Z0-9._-]+$")
+	ItemNameRX = regexp.MustCompile("^[a-z0-9_-]+$")
+	ReasonRX   = regexp.MustCompile("^[a-z0-9_-]+$")
 )
 
 type Validator struct {
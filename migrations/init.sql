@@ -2,12 +2,18 @@ CREATE TABLE users (
 	id SERIAL PRIMARY KEY,
 	balance INT DEFAULT 1000 CHECK(balance >= 0),
 	username VARCHAR(255) UNIQUE NOT NULL,
-	password VARCHAR(255) NOT NULL
+	password VARCHAR(255) NOT NULL,
+	role VARCHAR(32) NOT NULL DEFAULT 'employee' CHECK (role IN ('employee', 'shop-manager', 'admin')),
+	sessions_revoked_at TIMESTAMP WITH TIME ZONE
 );
 CREATE TABLE items (
 	id SERIAL PRIMARY KEY, 
 	name VARCHAR(255) UNIQUE NOT NULL,
-	price INT NOT NULL CHECK(price >=0)
+	price INT NOT NULL CHECK(price >=0),
+	description TEXT NOT NULL DEFAULT '',
+	stock INT CHECK (stock >= 0),
+	purchase_limit INT CHECK (purchase_limit > 0),
+	archived BOOLEAN NOT NULL DEFAULT false
 );
 CREATE TABLE user_items (
     user_id INT REFERENCES users(id) ON DELETE CASCADE,
@@ -20,13 +26,167 @@ CREATE INDEX idx_user_items_item_id ON user_items(item_id);
 
 CREATE TABLE transactions (
     id SERIAL PRIMARY KEY,
+    public_id UUID UNIQUE NOT NULL DEFAULT gen_random_uuid(),
     from_user_id INT REFERENCES users(id) ON DELETE CASCADE,
     to_user_id INT REFERENCES users(id) ON DELETE CASCADE,
-    amount INT NOT NULL CHECK (amount > 0)
+    amount INT NOT NULL CHECK (amount > 0),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
 );
 CREATE INDEX idx_transactions_from_user_id ON transactions(from_user_id);
 CREATE INDEX idx_transactions_to_user_id ON transactions(to_user_id);
 
+CREATE TABLE orders (
+    id SERIAL PRIMARY KEY,
+    public_id UUID UNIQUE NOT NULL DEFAULT gen_random_uuid(),
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'placed' CHECK (status IN ('placed', 'picked', 'shipped', 'delivered', 'cancelled')),
+    total INT NOT NULL CHECK (total >= 0),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT now()
+);
+CREATE INDEX idx_orders_user_id ON orders(user_id);
+CREATE INDEX idx_orders_status ON orders(status);
+
+CREATE TABLE order_lines (
+    id SERIAL PRIMARY KEY,
+    public_id UUID UNIQUE NOT NULL DEFAULT gen_random_uuid(),
+    order_id INT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    item_id INT NOT NULL REFERENCES items(id),
+    quantity INT NOT NULL CHECK (quantity > 0),
+    returned_quantity INT NOT NULL DEFAULT 0 CHECK (returned_quantity >= 0 AND returned_quantity <= quantity),
+    unit_price INT NOT NULL CHECK (unit_price >= 0),
+    UNIQUE (order_id, item_id)
+);
+
+CREATE TABLE refunds (
+    id SERIAL PRIMARY KEY,
+    public_id UUID UNIQUE NOT NULL DEFAULT gen_random_uuid(),
+    order_id INT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    item_id INT NOT NULL REFERENCES items(id),
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    amount INT NOT NULL CHECK (amount >= 0),
+    refunded_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+CREATE INDEX idx_refunds_user_id ON refunds(user_id);
+
+-- An append-only record of every coin movement, written in the same
+-- transaction as the change to users.balance it records. Balances are still
+-- read from users.balance, the ledger is what they are checked and reconciled
+-- against. Every entry moves coins between accounts with postings that sum to
+-- zero: user wallets, the shop which coins are spent in and the mint they are
+-- created by.
+CREATE TABLE ledger_entries (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('opening', 'transfer', 'mint', 'purchase', 'refund')),
+    reference UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE TABLE ledger_postings (
+    id SERIAL PRIMARY KEY,
+    entry_id INT NOT NULL REFERENCES ledger_entries(id),
+    account VARCHAR(16) NOT NULL CHECK (account IN ('user', 'shop', 'mint')),
+    user_id INT REFERENCES users(id),
+    amount INT NOT NULL CHECK (amount <> 0),
+    CHECK ((account = 'user') = (user_id IS NOT NULL))
+);
+CREATE INDEX idx_ledger_postings_entry_id ON ledger_postings(entry_id);
+CREATE INDEX idx_ledger_postings_user_id ON ledger_postings(user_id);
+
+CREATE FUNCTION check_ledger_entry_balanced() RETURNS trigger AS $$
+BEGIN
+    IF (SELECT sum(amount) FROM ledger_postings WHERE entry_id = NEW.entry_id) <> 0 THEN
+        RAISE EXCEPTION 'ledger entry % is not balanced', NEW.entry_id USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Checked at commit, the postings of an entry are inserted one by one
+CREATE CONSTRAINT TRIGGER ledger_postings_balanced
+    AFTER INSERT ON ledger_postings
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION check_ledger_entry_balanced();
+
+CREATE FUNCTION reject_ledger_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'the ledger is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER ledger_entries_append_only
+    BEFORE UPDATE OR DELETE ON ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+CREATE TRIGGER ledger_postings_append_only
+    BEFORE UPDATE OR DELETE ON ledger_postings
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+
+-- Corrections of a stored balance which drifted from the ledger
+CREATE TABLE balance_adjustments (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    old_balance INT NOT NULL,
+    new_balance INT NOT NULL,
+    reason VARCHAR(64) NOT NULL,
+    adjusted_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+CREATE INDEX idx_balance_adjustments_user_id ON balance_adjustments(user_id);
+
+CREATE TABLE carts (
+    id SERIAL PRIMARY KEY,
+    user_id INT UNIQUE NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    updated_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE TABLE cart_lines (
+    cart_id INT REFERENCES carts(id) ON DELETE CASCADE,
+    item_id INT REFERENCES items(id) ON DELETE CASCADE,
+    quantity INT NOT NULL CHECK (quantity > 0 AND quantity <= 1000),
+    added_price INT NOT NULL,
+    added_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT now(),
+    PRIMARY KEY (cart_id, item_id)
+);
+
+CREATE TABLE refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    token_hash BYTEA UNIQUE NOT NULL,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    family VARCHAR(32) NOT NULL,
+    expires_at TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP(0) WITH TIME ZONE
+);
+CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX idx_refresh_tokens_family ON refresh_tokens(family);
+
+CREATE TABLE revoked_tokens (
+    jti VARCHAR(32) PRIMARY KEY,
+    expires_at TIMESTAMP(0) WITH TIME ZONE NOT NULL
+);
+
+-- A NULL status marks a request still being processed, a retry takes the key
+-- over once locked_until has passed
+CREATE TABLE idempotency_keys (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key VARCHAR(255) NOT NULL,
+    fingerprint BYTEA NOT NULL,
+    status INT,
+    response BYTEA,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, key)
+);
+CREATE INDEX idx_idempotency_keys_created_at ON idempotency_keys(created_at);
+
+-- Keyed by the username sent, so unknown usernames are throttled like real ones
+CREATE TABLE login_failures (
+    username VARCHAR(255) PRIMARY KEY,
+    failures INT NOT NULL,
+    last_failed_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
 
 INSERT INTO items (name, price) VALUES ('t-shirt', 80);
 INSERT INTO items (name, price) VALUES ('cup', 20);
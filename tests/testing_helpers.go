@@ -2,9 +2,11 @@ package tests
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
@@ -12,6 +14,7 @@ import (
 
 	"math/rand"
 
+	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,6 +23,8 @@ const (
 	apiURL             = "http://localhost:8080/api"
 	amountconst        = 1000
 	numberofoperations = 10
+	adminUsername      = "shop_admin"
+	adminPassword      = "shop_admin_password"
 )
 
 var (
@@ -72,19 +77,22 @@ func stopServer(app *cmd.application) {
 
 func authenticateUser(t *testing.T, username, password string) string {
 	payload := fmt.Sprintf(`{"username": "%s", "password": "%s"}`, username, password)
-	req, err := http.NewRequest("POST", apiURL+"/auth", bytes.NewBufferString(payload))
-	assert.NoError(t, err, "Failed to create auth request")
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	assert.NoError(t, err, "Auth request failed")
+	resp := makeRequest(t, "POST", apiURL+"/auth", "", []byte(payload))
+	// Logins are rate limited per client address, wait for the quota when many
+	// users log in at once
+	for resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		resp.Body.Close()
+		wait, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		assert.NoError(t, err, "Retry-After should be set")
+		time.Sleep(time.Duration(wait) * time.Second)
+		resp = makeRequest(t, "POST", apiURL+"/auth", "", []byte(payload))
+	}
 	defer resp.Body.Close()
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode, "Auth should return 200 OK")
 
 	var response map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&response)
+	err := json.NewDecoder(resp.Body).Decode(&response)
 	assert.NoError(t, err, "Failed to decode auth response")
 
 	jwtToken, ok := response["token"].(string)
@@ -94,6 +102,30 @@ func authenticateUser(t *testing.T, username, password string) string {
 	return jwtToken
 }
 
+// openDB connects to the database of the server under test, for the states
+// the API cannot reach.
+func openDB(t *testing.T) *sql.DB {
+	dsn := fmt.Sprintf("postgres://%s:%s@%s:5432/%s?sslmode=disable",
+		os.Getenv("DATABASE_USER"),
+		os.Getenv("DATABASE_PASSWORD"),
+		os.Getenv("DATABASE_HOST"),
+		os.Getenv("DATABASE_NAME"),
+	)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open the database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func userID(t *testing.T, db *sql.DB, username string) int64 {
+	var id int64
+	err := db.QueryRow(`SELECT id FROM users WHERE username = $1`, username).Scan(&id)
+	assert.NoError(t, err, "Failed to look up the user")
+	return id
+}
+
 func makeRequest(t *testing.T, method, url, token string, body []byte) *http.Response {
 	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
 	assert.NoError(t, err, "Failed to create request")
@@ -110,6 +142,21 @@ func makeRequest(t *testing.T, method, url, token string, body []byte) *http.Res
 	return resp
 }
 
+func createItem(t *testing.T, token, name string, price int) int64 {
+	payload := fmt.Sprintf(`{"name": "%s", "price": %d}`, name, price)
+	resp := makeRequest(t, "POST", apiURL+"/admin/items", token, []byte(payload))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "Creating an item should return 201 Created")
+
+	var response struct {
+		Item struct {
+			ID int64 `json:"id"`
+		} `json:"item"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	assert.NoError(t, err, "Failed to decode create item response")
+	return response.Item.ID
+}
+
 func GenerateRandomStringSample(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	if length <= 0 {
@@ -2,9 +2,15 @@ package tests
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -118,6 +124,237 @@ func TestSendCoins(t *testing.T) {
 	assert.GreaterOrEqual(t, coins2, 100, "User2's balance should reflect the received coins")
 }
 
+// TestTransferHistory tests that transfers and purchases are listed with their ids and timestamps.
+func TestTransferHistory(t *testing.T) {
+	user1, password1 := Generate_Username_Password(1)
+	token1 := authenticateUser(t, user1, password1)
+	user2, password2 := Generate_Username_Password(2)
+	token2 := authenticateUser(t, user2, password2)
+
+	// Step 1: The transfer gets a public id
+	payload := fmt.Sprintf(`{"amount": 100, "toUser": "%s"}`, user2)
+	resp := makeRequest(t, "POST", apiURL+"/sendCoin", token1, []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Sending coins should return 200 OK")
+
+	var sent struct {
+		Transfer struct {
+			ID        string    `json:"id"`
+			ToUser    string    `json:"toUser"`
+			Amount    int       `json:"amount"`
+			CreatedAt time.Time `json:"createdAt"`
+		} `json:"transfer"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&sent)
+	assert.NoError(t, err, "Failed to decode send coin response")
+	assert.NotEmpty(t, sent.Transfer.ID, "The transfer should have an id")
+	assert.Equal(t, user2, sent.Transfer.ToUser, "The transfer should name the receiver")
+
+	resp = makeRequest(t, "GET", apiURL+"/buy/cup", token2, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Buying an item should return 200 OK")
+
+	// Step 2: The receiver sees the same transfer and the purchase with their dates
+	resp = makeRequest(t, "GET", apiURL+"/info?history=itemised", token2, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Requesting user info should return 200 OK")
+
+	var info struct {
+		CoinHistory struct {
+			Received []struct {
+				ID        string    `json:"id"`
+				FromUser  string    `json:"fromUser"`
+				CreatedAt time.Time `json:"createdAt"`
+			} `json:"received"`
+			Purchases []struct {
+				ID        string    `json:"id"`
+				Item      string    `json:"item"`
+				Quantity  int       `json:"quantity"`
+				Price     int       `json:"price"`
+				Amount    int       `json:"amount"`
+				CreatedAt time.Time `json:"createdAt"`
+			} `json:"purchases"`
+		} `json:"coinHistory"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	assert.NoError(t, err, "Failed to decode user info response")
+
+	if assert.Len(t, info.CoinHistory.Received, 1, "The receiver should see one transfer") {
+		received := info.CoinHistory.Received[0]
+		assert.Equal(t, sent.Transfer.ID, received.ID, "Both parties should see the same transfer id")
+		assert.Equal(t, user1, received.FromUser, "The transfer should name the sender")
+		assert.WithinDuration(t, sent.Transfer.CreatedAt, received.CreatedAt, time.Second, "The transfer should keep its creation time")
+	}
+	if assert.Len(t, info.CoinHistory.Purchases, 1, "The buyer should see one purchase") {
+		purchase := info.CoinHistory.Purchases[0]
+		assert.NotEmpty(t, purchase.ID, "The purchase should have an id")
+		assert.Equal(t, "cup", purchase.Item, "The purchase should name the item")
+		assert.Equal(t, 1, purchase.Quantity, "The purchase should show the quantity")
+		assert.Equal(t, 20, purchase.Price, "The purchase should show the price paid")
+		assert.Equal(t, 20, purchase.Amount, "The purchase should show the coins debited")
+		assert.WithinDuration(t, time.Now(), purchase.CreatedAt, time.Minute, "The purchase should have a creation time")
+	}
+}
+
+// TestGroupedHistory tests that transfers are summed per counterparty by default.
+func TestGroupedHistory(t *testing.T) {
+	user1, password1 := Generate_Username_Password(1)
+	token1 := authenticateUser(t, user1, password1)
+	user2, password2 := Generate_Username_Password(2)
+	authenticateUser(t, user2, password2)
+	user3, password3 := Generate_Username_Password(3)
+	authenticateUser(t, user3, password3)
+
+	// Step 1: Send twice to one user and once to another
+	for _, transfer := range []struct {
+		to     string
+		amount int
+	}{{user2, 100}, {user2, 50}, {user3, 30}} {
+		payload := fmt.Sprintf(`{"amount": %d, "toUser": "%s"}`, transfer.amount, transfer.to)
+		resp := makeRequest(t, "POST", apiURL+"/sendCoin", token1, []byte(payload))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Sending coins should return 200 OK")
+	}
+
+	type history struct {
+		CoinHistory struct {
+			Sent []struct {
+				ToUser string `json:"toUser"`
+				Amount int    `json:"amount"`
+				Count  int    `json:"count"`
+			} `json:"sent"`
+		} `json:"coinHistory"`
+	}
+
+	// Step 2: The default view has one entry per receiver, largest first
+	resp := makeRequest(t, "GET", apiURL+"/info", token1, nil)
+	var grouped history
+	err := json.NewDecoder(resp.Body).Decode(&grouped)
+	assert.NoError(t, err, "Failed to decode info response")
+	if assert.Len(t, grouped.CoinHistory.Sent, 2, "Transfers should be grouped per receiver") {
+		assert.Equal(t, user2, grouped.CoinHistory.Sent[0].ToUser)
+		assert.Equal(t, 150, grouped.CoinHistory.Sent[0].Amount, "Amounts should be summed")
+		assert.Equal(t, 2, grouped.CoinHistory.Sent[0].Count, "Transfers should be counted")
+		assert.Equal(t, user3, grouped.CoinHistory.Sent[1].ToUser)
+		assert.Equal(t, 30, grouped.CoinHistory.Sent[1].Amount)
+	}
+
+	// Step 3: The itemised view lists every transfer
+	resp = makeRequest(t, "GET", apiURL+"/info?history=itemised", token1, nil)
+	var itemised history
+	err = json.NewDecoder(resp.Body).Decode(&itemised)
+	assert.NoError(t, err, "Failed to decode info response")
+	assert.Len(t, itemised.CoinHistory.Sent, 3, "Every transfer should be listed")
+
+	resp = makeRequest(t, "GET", apiURL+"/info?history=daily", token1, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "An unknown history view should be rejected")
+}
+
+// TestHistory pages through the history with a cursor and filters it.
+func TestHistory(t *testing.T) {
+	user1, password1 := Generate_Username_Password(1)
+	token1 := authenticateUser(t, user1, password1)
+	user2, password2 := Generate_Username_Password(2)
+	authenticateUser(t, user2, password2)
+	user3, password3 := Generate_Username_Password(3)
+	authenticateUser(t, user3, password3)
+
+	// Step 1: Send three times to one user and once to another
+	for _, transfer := range []struct {
+		to     string
+		amount int
+	}{{user2, 10}, {user2, 20}, {user2, 30}, {user3, 40}} {
+		payload := fmt.Sprintf(`{"amount": %d, "toUser": "%s"}`, transfer.amount, transfer.to)
+		resp := makeRequest(t, "POST", apiURL+"/sendCoin", token1, []byte(payload))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Sending coins should return 200 OK")
+	}
+
+	type page struct {
+		History []struct {
+			ID           string `json:"id"`
+			Direction    string `json:"direction"`
+			Counterparty string `json:"counterparty"`
+			Item         string `json:"item"`
+			Quantity     int    `json:"quantity"`
+			Price        int    `json:"price"`
+			Amount       int    `json:"amount"`
+		} `json:"history"`
+		Metadata struct {
+			NextCursor string `json:"next_cursor"`
+		} `json:"metadata"`
+	}
+	getPage := func(query string) page {
+		resp := makeRequest(t, "GET", apiURL+"/history?"+query, token1, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Getting the history should return 200 OK")
+		var p page
+		err := json.NewDecoder(resp.Body).Decode(&p)
+		assert.NoError(t, err, "Failed to decode history response")
+		return p
+	}
+
+	// Step 2: Page through the transfers sent, newest first
+	first := getPage("direction=sent&limit=3")
+	assert.Len(t, first.History, 3, "The first page should be full")
+	assert.NotEmpty(t, first.Metadata.NextCursor, "The first page should have a next cursor")
+	if len(first.History) > 0 {
+		assert.Equal(t, 40, first.History[0].Amount, "The newest transfer should come first")
+	}
+
+	second := getPage("direction=sent&limit=3&cursor=" + first.Metadata.NextCursor)
+	if assert.Len(t, second.History, 1, "The second page should hold the rest") {
+		assert.Equal(t, 10, second.History[0].Amount, "The oldest transfer should come last")
+	}
+	assert.Empty(t, second.Metadata.NextCursor, "The last page should have no next cursor")
+
+	// Step 3: Filter by counterparty and amount range
+	filtered := getPage("counterparty=" + user2 + "&min_amount=15&max_amount=30")
+	assert.Len(t, filtered.History, 2, "Only the matching transfers should be listed")
+	for _, entry := range filtered.History {
+		assert.Equal(t, "sent", entry.Direction)
+		assert.Equal(t, user2, entry.Counterparty)
+	}
+
+	// Step 4: A purchase is listed per item with the price paid
+	payload := `{"items": [{"item": "cup", "quantity": 2}, {"item": "pen", "quantity": 1}]}`
+	resp := makeRequest(t, "POST", apiURL+"/checkout", token1, []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Checkout should return 200 OK")
+
+	purchases := getPage("direction=purchase")
+	assert.Len(t, purchases.History, 2, "Every item bought should be listed")
+	for _, entry := range purchases.History {
+		switch entry.Item {
+		case "cup":
+			assert.Equal(t, 2, entry.Quantity)
+			assert.Equal(t, 20, entry.Price)
+			assert.Equal(t, 40, entry.Amount)
+		case "pen":
+			assert.Equal(t, 1, entry.Quantity)
+			assert.Equal(t, 10, entry.Price)
+			assert.Equal(t, 10, entry.Amount)
+		default:
+			t.Errorf("Unexpected item %q in the history", entry.Item)
+		}
+	}
+
+	// Step 5: A returned item is listed as a refund
+	var receipt struct {
+		OrderID int64 `json:"orderId"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&receipt)
+	assert.NoError(t, err, "Failed to decode checkout response")
+	resp = makeRequest(t, "POST", fmt.Sprintf("%s/orders/%d/return", apiURL, receipt.OrderID), token1, []byte(`{"item": "cup", "quantity": 1}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Returning an item should return 200 OK")
+
+	refunds := getPage("direction=refund")
+	if assert.Len(t, refunds.History, 1, "The refund should be listed") {
+		assert.Equal(t, "cup", refunds.History[0].Item)
+		assert.Equal(t, 1, refunds.History[0].Quantity)
+		assert.Equal(t, 20, refunds.History[0].Amount)
+	}
+
+	// Step 6: Invalid parameters are rejected
+	for _, query := range []string{"cursor=garbage", "direction=lost", "limit=0", "min_amount=5&max_amount=1", "direction=refund&counterparty=" + user2} {
+		resp := makeRequest(t, "GET", apiURL+"/history?"+query, token1, nil)
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Query %q should be rejected", query)
+	}
+}
+
 // TestInsufficientBalance tests sending coins when the sender has insufficient balance.
 func TestInsufficientBalance(t *testing.T) {
 	// Step 1: Authenticate two users
@@ -136,6 +373,182 @@ func TestInsufficientBalance(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Sending more coins than balance should return 400 Bad Request")
 }
 
+// TestConcurrentSendCoins tests that concurrent transfers never overdraw the sender.
+func TestConcurrentSendCoins(t *testing.T) {
+	user1, password1 := Generate_Username_Password(1)
+	token1 := authenticateUser(t, user1, password1)
+	user2, password2 := Generate_Username_Password(2)
+	token2 := authenticateUser(t, user2, password2)
+
+	// Step 1: Send 100 coins twenty times at once, only ten transfers can succeed
+	payload := fmt.Sprintf(`{"amount": 100, "toUser": "%s"}`, user2)
+	statuses := make(chan int, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := makeRequest(t, "POST", apiURL+"/sendCoin", token1, []byte(payload))
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	succeeded := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+			continue
+		}
+		assert.Equal(t, http.StatusBadRequest, status, "Failed transfers should return 400 Bad Request")
+	}
+	assert.Equal(t, amountconst/100, succeeded, "Only transfers covered by the balance should succeed")
+
+	// Step 2: No coins are lost or created
+	coins1, _ := RequestUserInfo(t, token1)
+	coins2, _ := RequestUserInfo(t, token2)
+	assert.Equal(t, 0, coins1, "The sender should have spent the whole balance")
+	assert.Equal(t, 2*amountconst, coins2, "The receiver should get every transferred coin")
+}
+
+// TestIdempotentSendCoin tests that a transfer retried with the same Idempotency-Key happens once.
+func TestIdempotentSendCoin(t *testing.T) {
+	user1, password1 := Generate_Username_Password(1)
+	token1 := authenticateUser(t, user1, password1)
+	user2, password2 := Generate_Username_Password(2)
+	token2 := authenticateUser(t, user2, password2)
+
+	send := func(key, payload string) *http.Response {
+		req, err := http.NewRequest("POST", apiURL+"/sendCoin", bytes.NewBufferString(payload))
+		assert.NoError(t, err, "Failed to create send coin request")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token1)
+		req.Header.Set("Idempotency-Key", key)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Send coin request failed")
+		return resp
+	}
+
+	// Step 1: The retry gets the original response without a second transfer
+	payload := fmt.Sprintf(`{"amount": 100, "toUser": "%s"}`, user2)
+	resp := send("transfer-1", payload)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Sending coins should return 200 OK")
+	resp = send("transfer-1", payload)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "A replay should return the original status")
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"), "A replay should be marked as such")
+
+	coins1, _ := RequestUserInfo(t, token1)
+	coins2, _ := RequestUserInfo(t, token2)
+	assert.Equal(t, amountconst-100, coins1, "The sender should be debited once")
+	assert.Equal(t, amountconst+100, coins2, "The receiver should be credited once")
+
+	// Step 2: The key cannot be reused for another request
+	payload = fmt.Sprintf(`{"amount": 200, "toUser": "%s"}`, user2)
+	resp = send("transfer-1", payload)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Reusing a key for another request should return 422")
+
+	// Step 3: A new key makes a new transfer
+	resp = send("transfer-2", payload)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Sending coins with a new key should return 200 OK")
+	coins1, _ = RequestUserInfo(t, token1)
+	assert.Equal(t, amountconst-300, coins1, "The sender should be debited for the new transfer")
+}
+
+// TestIdempotencyLease tests that a key left reserved by a request which died is taken over once its lease ran out.
+func TestIdempotencyLease(t *testing.T) {
+	user1, password1 := Generate_Username_Password(1)
+	token1 := authenticateUser(t, user1, password1)
+	user2, password2 := Generate_Username_Password(2)
+	authenticateUser(t, user2, password2)
+
+	payload := fmt.Sprintf(`{"amount": 100, "toUser": "%s"}`, user2)
+	send := func(key string) *http.Response {
+		req, err := http.NewRequest("POST", apiURL+"/sendCoin", bytes.NewBufferString(payload))
+		assert.NoError(t, err, "Failed to create send coin request")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token1)
+		req.Header.Set("Idempotency-Key", key)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Send coin request failed")
+		return resp
+	}
+
+	// Step 1: Reserve two keys as requests which never finished would have
+	db := openDB(t)
+	id := userID(t, db, user1)
+	fingerprint := sha256.Sum256([]byte("POST /api/sendCoin\n" + payload))
+	stmt := `INSERT INTO idempotency_keys (user_id, key, fingerprint, locked_until) VALUES ($1, $2, $3, now() + $4 * interval '1 second')`
+	_, err := db.Exec(stmt, id, "running", fingerprint[:], 60)
+	assert.NoError(t, err, "Failed to reserve a key")
+	_, err = db.Exec(stmt, id, "died", fingerprint[:], -1)
+	assert.NoError(t, err, "Failed to reserve a key")
+
+	// Step 2: A key within its lease is still being processed
+	resp := send("running")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "A key in use should return 409 Conflict")
+
+	// Step 3: A key past its lease is taken over by the retry
+	resp = send("died")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "A retry after the lease should return 200 OK")
+	coins, _ := RequestUserInfo(t, token1)
+	assert.Equal(t, amountconst-100, coins, "The retry should make the transfer")
+
+	resp = send("died")
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"), "The key should now replay the response")
+}
+
+// TestRateLimitHeaders tests that rate limited routes report the client's quota.
+func TestRateLimitHeaders(t *testing.T) {
+	username, password := Generate_Username_Password(1)
+	token := authenticateUser(t, username, password)
+
+	// Step 1: Every request takes a token from the user's bucket
+	resp := makeRequest(t, "GET", apiURL+"/info", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Getting info should return 200 OK")
+	limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+	assert.NoError(t, err, "X-RateLimit-Limit should be set")
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	assert.NoError(t, err, "X-RateLimit-Remaining should be set")
+	assert.Less(t, remaining, limit, "The request should be taken from the quota")
+	assert.NotEmpty(t, resp.Header.Get("X-RateLimit-Reset"), "X-RateLimit-Reset should be set")
+
+	// Step 2: Unauthenticated routes are limited per client address
+	resp = makeRequest(t, "GET", apiURL+"/items", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Listing items should return 200 OK")
+	assert.NotEmpty(t, resp.Header.Get("X-RateLimit-Limit"), "X-RateLimit-Limit should be set")
+}
+
+// TestRateLimitExceeded tests that a user over the quota of a route is refused until it refills.
+func TestRateLimitExceeded(t *testing.T) {
+	username, password := Generate_Username_Password(1)
+	token := authenticateUser(t, username, password)
+
+	// Step 1: Use up the user's history quota
+	resp := makeRequest(t, "GET", apiURL+"/history", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Getting the history should return 200 OK")
+	limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+	assert.NoError(t, err, "X-RateLimit-Limit should be set")
+	for i := 1; i < limit; i++ {
+		resp = makeRequest(t, "GET", apiURL+"/history", token, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Requests within the quota should return 200 OK")
+	}
+
+	// Step 2: The next request is refused and says when to retry
+	resp = makeRequest(t, "GET", apiURL+"/history", token, nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "A request over the quota should return 429 Too Many Requests")
+	assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Remaining"), "No request should be left")
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	assert.NoError(t, err, "Retry-After should be set")
+	assert.Positive(t, retryAfter, "Retry-After should be in the future")
+
+	// Step 3: Other routes keep their own quota
+	resp = makeRequest(t, "GET", apiURL+"/info", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Getting info should return 200 OK")
+}
+
 // TestBuyItemWithInsufficientBalance tests buying an item when the user has insufficient balance.
 func TestBuyItemWithInsufficientBalance(t *testing.T) {
 	username, password := Generate_Username_Password(1)
@@ -172,6 +585,623 @@ func TestInvalidAuth(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Authentication with invalid credentials should return 401 Unauthorized")
 }
 
+// TestAuthLongUsername tests that a username too long to be stored is refused.
+func TestAuthLongUsername(t *testing.T) {
+	payload := fmt.Sprintf(`{"username": "%s", "password": "password"}`, strings.Repeat("a", 256))
+	resp := makeRequest(t, "POST", apiURL+"/auth", "", []byte(payload))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "A username longer than 255 characters should return 400 Bad Request")
+}
+
+// TestLoginLockout tests that repeated failed logins throttle the username until an admin unlocks it.
+func TestLoginLockout(t *testing.T) {
+	username, password := Generate_Username_Password(1)
+	authenticateUser(t, username, password)
+	adminToken := authenticateUser(t, adminUsername, adminPassword)
+
+	// Step 1: The first failures are answered right away, the following ones delay the next attempt
+	payload := fmt.Sprintf(`{"username": "%s", "password": "invalid_password"}`, username)
+	for i := 0; i < 4; i++ {
+		resp := makeRequest(t, "POST", apiURL+"/auth", "", []byte(payload))
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "A wrong password should return 401 Unauthorized")
+	}
+
+	// Step 2: Even the right password is refused while the login is throttled
+	payload = fmt.Sprintf(`{"username": "%s", "password": "%s"}`, username, password)
+	resp := makeRequest(t, "POST", apiURL+"/auth", "", []byte(payload))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "A throttled login should return 429 Too Many Requests")
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"), "A throttled login should say when to retry")
+
+	// Step 3: An admin unlocks the username
+	resp = makeRequest(t, "POST", apiURL+"/admin/users/"+username+"/unlock", adminToken, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Unlocking a login should return 200 OK")
+
+	resp = makeRequest(t, "POST", apiURL+"/auth", "", []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "An unlocked login should succeed")
+}
+
+// TestRepeatedAuth tests that a registered user can log in again with the same password.
+func TestRepeatedAuth(t *testing.T) {
+	username, password := Generate_Username_Password(1)
+	authenticateUser(t, username, password)
+
+	// The stored password is hashed, the second login must still succeed
+	token := authenticateUser(t, username, password)
+	assert.NotEmpty(t, token, "Repeated authentication should return a token")
+}
+
+// TestConcurrentFirstLogin tests that simultaneous first logins of a new user all succeed.
+func TestConcurrentFirstLogin(t *testing.T) {
+	username, password := Generate_Username_Password(1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			authenticateUser(t, username, password)
+		}()
+	}
+	wg.Wait()
+
+	// Only one account was created, with a single opening balance
+	token := authenticateUser(t, username, password)
+	coins, _ := RequestUserInfo(t, token)
+	assert.Equal(t, amountconst, coins, "The user should be created once")
+}
+
+// TestRegister tests explicit registration and its validation.
+func TestRegister(t *testing.T) {
+	username, _ := Generate_Username_Password(1)
+	payload := fmt.Sprintf(`{"username": "%s", "password": "long-enough-password"}`, username)
+
+	resp := makeRequest(t, "POST", apiURL+"/register", "", []byte(payload))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "Registering a new user should return 201 Created")
+
+	resp = makeRequest(t, "POST", apiURL+"/register", "", []byte(payload))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Registering a taken username should return 422")
+
+	username, _ = Generate_Username_Password(2)
+	payload = fmt.Sprintf(`{"username": "%s", "password": "short"}`, username)
+	resp = makeRequest(t, "POST", apiURL+"/register", "", []byte(payload))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Registering with a weak password should return 422")
+
+	token := authenticateUser(t, username+"x", "long-enough-password")
+	assert.NotEmpty(t, token, "Auto-registration on first login should still work")
+}
+
+// TestRefreshAndLogout tests refresh token rotation, reuse detection and logout.
+func TestRefreshAndLogout(t *testing.T) {
+	username, password := Generate_Username_Password(1)
+	payload := fmt.Sprintf(`{"username": "%s", "password": "%s"}`, username, password)
+	resp := makeRequest(t, "POST", apiURL+"/auth", "", []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Auth should return 200 OK")
+
+	var tokens struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refreshToken"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&tokens)
+	assert.NoError(t, err, "Failed to decode auth response")
+	assert.NotEmpty(t, tokens.RefreshToken, "Auth should return a refresh token")
+
+	// Step 1: Rotate the refresh token
+	oldRefresh := tokens.RefreshToken
+	payload = fmt.Sprintf(`{"refreshToken": "%s"}`, oldRefresh)
+	resp = makeRequest(t, "POST", apiURL+"/auth/refresh", "", []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Refreshing should return 200 OK")
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	assert.NoError(t, err, "Failed to decode refresh response")
+	RequestUserInfo(t, tokens.Token)
+
+	// Step 2: Reusing the rotated token revokes the whole family
+	resp = makeRequest(t, "POST", apiURL+"/auth/refresh", "", []byte(payload))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Reusing a refresh token should return 401 Unauthorized")
+	payload = fmt.Sprintf(`{"refreshToken": "%s"}`, tokens.RefreshToken)
+	resp = makeRequest(t, "POST", apiURL+"/auth/refresh", "", []byte(payload))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "The family of a reused token should be revoked")
+
+	// Step 3: The access token stops working after logout
+	resp = makeRequest(t, "POST", apiURL+"/auth/logout", tokens.Token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Logout should return 200 OK")
+	resp = makeRequest(t, "GET", apiURL+"/info", tokens.Token, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "A revoked token should return 401 Unauthorized")
+
+	// Step 4: Logging out everywhere revokes older tokens but not a login right after it
+	oldToken := authenticateUser(t, username, password)
+	resp = makeRequest(t, "POST", apiURL+"/auth/logout", oldToken, []byte(`{"allSessions": true}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Logging out everywhere should return 200 OK")
+	newToken := authenticateUser(t, username, password)
+	resp = makeRequest(t, "GET", apiURL+"/info", oldToken, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Tokens issued before logging out everywhere should be revoked")
+	resp = makeRequest(t, "GET", apiURL+"/info", newToken, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "A login right after logging out everywhere should work")
+}
+
+// TestAdminAccess tests that admin endpoints are protected by the admin role.
+func TestAdminAccess(t *testing.T) {
+	username, password := Generate_Username_Password(1)
+	token := authenticateUser(t, username, password)
+	adminToken := authenticateUser(t, adminUsername, adminPassword)
+
+	// Step 1: An employee cannot mint coins
+	payload := fmt.Sprintf(`{"amount": 100, "toUser": "%s"}`, username)
+	resp := makeRequest(t, "POST", apiURL+"/admin/mint", token, []byte(payload))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Minting coins as an employee should return 403 Forbidden")
+
+	// Step 2: An admin can
+	coins, _ := RequestUserInfo(t, token)
+	resp = makeRequest(t, "POST", apiURL+"/admin/mint", adminToken, []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Minting coins as an admin should return 200 OK")
+	newCoins, _ := RequestUserInfo(t, token)
+	assert.Equal(t, coins+100, newCoins, "Minted coins should be credited to the receiver")
+
+	// Step 3: Changing the role revokes the user's tokens
+	resp = makeRequest(t, "PUT", apiURL+"/admin/users/"+username+"/role", adminToken, []byte(`{"role": "shop-manager"}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Changing a role as an admin should return 200 OK")
+	resp = makeRequest(t, "GET", apiURL+"/info", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Tokens issued before a role change should be revoked")
+}
+
+// TestLedgerBalance tests that every movement of coins is posted to the ledger.
+func TestLedgerBalance(t *testing.T) {
+	user1, password1 := Generate_Username_Password(1)
+	token1 := authenticateUser(t, user1, password1)
+	user2, password2 := Generate_Username_Password(2)
+	authenticateUser(t, user2, password2)
+	adminToken := authenticateUser(t, adminUsername, adminPassword)
+
+	// Step 1: Transfer, mint, buy and return
+	payload := fmt.Sprintf(`{"amount": 100, "toUser": "%s"}`, user2)
+	resp := makeRequest(t, "POST", apiURL+"/sendCoin", token1, []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Sending coins should return 200 OK")
+
+	payload = fmt.Sprintf(`{"amount": 50, "toUser": "%s"}`, user1)
+	resp = makeRequest(t, "POST", apiURL+"/admin/mint", adminToken, []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Minting coins should return 200 OK")
+
+	resp = makeRequest(t, "POST", apiURL+"/checkout", token1, []byte(`{"items": [{"item": "book", "quantity": 2}]}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Checkout should return 200 OK")
+	var receipt struct {
+		OrderID int64 `json:"orderId"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&receipt)
+	assert.NoError(t, err, "Failed to decode checkout response")
+
+	resp = makeRequest(t, "POST", fmt.Sprintf("%s/orders/%d/return", apiURL, receipt.OrderID), token1, []byte(`{"item": "book", "quantity": 1}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Returning an item should return 200 OK")
+
+	// Step 2: The balances derived from the ledger match the stored ones
+	for _, user := range []struct {
+		name  string
+		coins int
+	}{{user1, 1000 - 100 + 50 - 100 + 50}, {user2, 1000 + 100}} {
+		resp = makeRequest(t, "GET", apiURL+"/admin/users/"+user.name+"/balance", adminToken, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Checking a balance should return 200 OK")
+
+		var check struct {
+			Balance struct {
+				Stored     int  `json:"stored"`
+				Ledger     int  `json:"ledger"`
+				Consistent bool `json:"consistent"`
+			} `json:"balance"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&check)
+		assert.NoError(t, err, "Failed to decode balance response")
+		assert.Equal(t, user.coins, check.Balance.Ledger, "The ledger should hold every movement of %s", user.name)
+		assert.True(t, check.Balance.Consistent, "The stored balance of %s should match the ledger", user.name)
+	}
+
+	// Step 3: Only admins can check balances
+	resp = makeRequest(t, "GET", apiURL+"/admin/users/"+user1+"/balance", token1, nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Checking a balance as an employee should return 403 Forbidden")
+}
+
+// TestReconcile tests that the balances recomputed from the history match the ledger and that a drifted balance is corrected.
+func TestReconcile(t *testing.T) {
+	user1, password1 := Generate_Username_Password(1)
+	token1 := authenticateUser(t, user1, password1)
+	user2, password2 := Generate_Username_Password(2)
+	authenticateUser(t, user2, password2)
+	adminToken := authenticateUser(t, adminUsername, adminPassword)
+
+	reconcile := func(opts server.ReconcileOptions) (string, int) {
+		var out bytes.Buffer
+		unresolved, err := app.Reconcile(context.Background(), opts, &out)
+		assert.NoError(t, err, "Reconcile should not fail")
+		for _, line := range strings.Split(out.String(), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && fields[0] == user1 {
+				return line, unresolved
+			}
+		}
+		return "", unresolved
+	}
+
+	// Step 1: Transfers, purchases and refunds add up to the ledger balance
+	payload := fmt.Sprintf(`{"amount": 100, "toUser": "%s"}`, user2)
+	resp := makeRequest(t, "POST", apiURL+"/sendCoin", token1, []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Sending coins should return 200 OK")
+	resp = makeRequest(t, "POST", apiURL+"/checkout", token1, []byte(`{"items": [{"item": "book", "quantity": 2}]}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Checkout should return 200 OK")
+	var receipt struct {
+		OrderID int64 `json:"orderId"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&receipt)
+	assert.NoError(t, err, "Failed to decode checkout response")
+	resp = makeRequest(t, "POST", fmt.Sprintf("%s/orders/%d/return", apiURL, receipt.OrderID), token1, []byte(`{"item": "book", "quantity": 1}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Returning an item should return 200 OK")
+
+	line, _ := reconcile(server.ReconcileOptions{})
+	assert.Empty(t, line, "A consistent balance should not be reported")
+
+	// Step 2: A stored balance changed outside of the ledger is reported
+	db := openDB(t)
+	_, err = db.Exec(`UPDATE users SET balance = balance + 7 WHERE username = $1`, user1)
+	assert.NoError(t, err, "Failed to make the balance drift")
+
+	line, unresolved := reconcile(server.ReconcileOptions{})
+	assert.Contains(t, line, "mismatch", "The drifted balance should be reported")
+	assert.Positive(t, unresolved, "The drifted balance should be left inconsistent")
+
+	// Step 3: Fixing sets the stored balance back to the ledger and records why
+	line, _ = reconcile(server.ReconcileOptions{Fix: true, Reason: "test-drift", Admin: adminUsername})
+	assert.Contains(t, line, "adjusted", "The drifted balance should be adjusted")
+
+	coins, _ := RequestUserInfo(t, token1)
+	assert.Equal(t, 1000-100-50, coins, "The balance should be back to the ledger balance")
+
+	resp = makeRequest(t, "GET", apiURL+"/admin/users/"+user1+"/balance", adminToken, nil)
+	var check struct {
+		Balance struct {
+			Consistent bool `json:"consistent"`
+		} `json:"balance"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&check)
+	assert.NoError(t, err, "Failed to decode balance response")
+	assert.True(t, check.Balance.Consistent, "The stored balance should match the ledger again")
+
+	var oldBalance, newBalance int
+	err = db.QueryRow(`SELECT old_balance, new_balance FROM balance_adjustments WHERE user_id = $1 AND reason = 'test-drift'`,
+		userID(t, db, user1)).Scan(&oldBalance, &newBalance)
+	assert.NoError(t, err, "The adjustment should be recorded")
+	assert.Equal(t, 7, oldBalance-newBalance, "The adjustment should undo the drift")
+}
+
+// TestCatalogManagement tests creating, archiving and restoring items.
+func TestCatalogManagement(t *testing.T) {
+	adminToken := authenticateUser(t, adminUsername, adminPassword)
+	username, password := Generate_Username_Password(1)
+	token := authenticateUser(t, username, password)
+
+	// Step 1: Employees cannot manage the catalog
+	resp := makeRequest(t, "POST", apiURL+"/admin/items", token, []byte(`{"name": "mug", "price": 10}`))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Creating an item as an employee should return 403 Forbidden")
+
+	// Step 2: Create an item and buy it
+	itemName := strings.ToLower(GenerateRandomStringSample(8)) + "-sticker"
+	itemID := createItem(t, adminToken, itemName, 5)
+	resp = makeRequest(t, "GET", apiURL+"/buy/"+itemName, token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Buying a new item should return 200 OK")
+
+	// Step 3: Archived items cannot be bought but stay in the inventory
+	resp = makeRequest(t, "POST", fmt.Sprintf("%s/admin/items/%d/archive", apiURL, itemID), adminToken, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Archiving an item should return 200 OK")
+	resp = makeRequest(t, "GET", apiURL+"/buy/"+itemName, token, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Buying an archived item should return 400 Bad Request")
+	_, inventory := RequestUserInfo(t, token)
+	assert.Len(t, inventory, 1, "Archived items should stay in the inventory")
+
+	// Step 4: Restore and change the price
+	resp = makeRequest(t, "POST", fmt.Sprintf("%s/admin/items/%d/restore", apiURL, itemID), adminToken, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Restoring an item should return 200 OK")
+	resp = makeRequest(t, "PATCH", fmt.Sprintf("%s/admin/items/%d", apiURL, itemID), adminToken, []byte(`{"price": 7}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Updating an item should return 200 OK")
+	coins, _ := RequestUserInfo(t, token)
+	resp = makeRequest(t, "GET", apiURL+"/buy/"+itemName, token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Buying a restored item should return 200 OK")
+	newCoins, _ := RequestUserInfo(t, token)
+	assert.Equal(t, coins-7, newCoins, "The updated price should be charged")
+}
+
+// TestListItems tests the public catalog listing.
+func TestListItems(t *testing.T) {
+	resp := makeRequest(t, "GET", apiURL+"/items?min_price=10&page_size=100", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Listing items should return 200 OK")
+
+	var response struct {
+		Items []struct {
+			Name      string `json:"name"`
+			Price     int    `json:"price"`
+			Available bool   `json:"available"`
+		} `json:"items"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	assert.NoError(t, err, "Failed to decode items response")
+
+	listed := make(map[string]int)
+	for _, item := range response.Items {
+		listed[item.Name] = item.Price
+	}
+	for i, name := range items {
+		assert.Equal(t, prices[i], listed[name], "Seeded item %s should be listed with its price", name)
+	}
+
+	// Filter by price range and sort by price
+	resp = makeRequest(t, "GET", apiURL+"/items?min_price=50&max_price=200&sort=-price", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Filtering items should return 200 OK")
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	assert.NoError(t, err, "Failed to decode items response")
+	for i, item := range response.Items {
+		assert.True(t, item.Price >= 50 && item.Price <= 200, "Listed price should be within the range")
+		if i > 0 {
+			assert.LessOrEqual(t, item.Price, response.Items[i-1].Price, "Items should be sorted by descending price")
+		}
+	}
+
+	resp = makeRequest(t, "GET", apiURL+"/items?sort=password", "", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "Unknown sort values should return 422")
+}
+
+// TestLimitedStock tests sold out items, restocking and per-user purchase caps.
+func TestLimitedStock(t *testing.T) {
+	adminToken := authenticateUser(t, adminUsername, adminPassword)
+	user1, password1 := Generate_Username_Password(1)
+	token1 := authenticateUser(t, user1, password1)
+	user2, password2 := Generate_Username_Password(2)
+	token2 := authenticateUser(t, user2, password2)
+
+	itemName := strings.ToLower(GenerateRandomStringSample(8)) + "-badge"
+	payload := fmt.Sprintf(`{"name": "%s", "price": 10, "stock": 1, "purchaseLimit": 1}`, itemName)
+	resp := makeRequest(t, "POST", apiURL+"/admin/items", adminToken, []byte(payload))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "Creating an item should return 201 Created")
+	var created struct {
+		Item struct {
+			ID int64 `json:"id"`
+		} `json:"item"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&created)
+	assert.NoError(t, err, "Failed to decode create item response")
+
+	// Step 1: The last unit is sold, the next buyer gets a sold out error and keeps the coins
+	resp = makeRequest(t, "GET", apiURL+"/buy/"+itemName, token1, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Buying the last unit should return 200 OK")
+	resp = makeRequest(t, "GET", apiURL+"/buy/"+itemName, token2, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "Buying a sold out item should return 409 Conflict")
+	coins, _ := RequestUserInfo(t, token2)
+	assert.Equal(t, amountconst, coins, "A failed purchase should not be charged")
+
+	// Step 2: After a restock the item can be bought again, but only once per user
+	resp = makeRequest(t, "POST", fmt.Sprintf("%s/admin/items/%d/restock", apiURL, created.Item.ID), adminToken, []byte(`{"quantity": 5}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Restocking an item should return 200 OK")
+	resp = makeRequest(t, "GET", apiURL+"/buy/"+itemName, token2, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Buying a restocked item should return 200 OK")
+	resp = makeRequest(t, "GET", apiURL+"/buy/"+itemName, token2, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Buying over the purchase limit should return 400 Bad Request")
+}
+
+// TestCheckout tests buying several items in one atomic checkout.
+func TestCheckout(t *testing.T) {
+	username, password := Generate_Username_Password(1)
+	token := authenticateUser(t, username, password)
+
+	// Step 1: Buy two cups and three pens, the total is debited once
+	payload := `{"items": [{"item": "cup", "quantity": 2}, {"item": "pen", "quantity": 3}]}`
+	resp := makeRequest(t, "POST", apiURL+"/checkout", token, []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Checkout should return 200 OK")
+	var receipt struct {
+		Total int `json:"total"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&receipt)
+	assert.NoError(t, err, "Failed to decode checkout response")
+	assert.Equal(t, 2*20+3*10, receipt.Total, "The receipt should contain the total price")
+
+	coins, inventory := RequestUserInfo(t, token)
+	assert.Equal(t, amountconst-70, coins, "The total should be debited")
+	quantities := make(map[string]int)
+	for _, item := range inventory {
+		quantities[item["item"].(string)] = int(item["quantity"].(float64))
+	}
+	assert.Equal(t, 2, quantities["cup"], "Both cups should be in the inventory")
+	assert.Equal(t, 3, quantities["pen"], "All pens should be in the inventory")
+
+	// Step 2: A cart with an unknown item buys nothing
+	payload = `{"items": [{"item": "cup", "quantity": 1}, {"item": "invalid-item", "quantity": 1}]}`
+	resp = makeRequest(t, "POST", apiURL+"/checkout", token, []byte(payload))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Checkout with an unknown item should return 400 Bad Request")
+
+	// Step 3: A cart the user cannot afford buys nothing
+	payload = `{"items": [{"item": "cup", "quantity": 1}, {"item": "pink-hoody", "quantity": 2}]}`
+	resp = makeRequest(t, "POST", apiURL+"/checkout", token, []byte(payload))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Checkout with insufficient funds should return 400 Bad Request")
+
+	newCoins, _ := RequestUserInfo(t, token)
+	assert.Equal(t, coins, newCoins, "Failed checkouts should not be charged")
+}
+
+// TestCart tests collecting items in the cart and checking it out at current prices.
+func TestCart(t *testing.T) {
+	adminToken := authenticateUser(t, adminUsername, adminPassword)
+	username, password := Generate_Username_Password(1)
+	token := authenticateUser(t, username, password)
+
+	itemName := strings.ToLower(GenerateRandomStringSample(8)) + "-badge"
+	itemID := createItem(t, adminToken, itemName, 10)
+
+	// Step 1: Add items to the cart
+	resp := makeRequest(t, "POST", apiURL+"/cart/items", token, []byte(`{"item": "cup", "quantity": 1}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Adding an item to the cart should return 200 OK")
+	payload := fmt.Sprintf(`{"item": "%s", "quantity": 1}`, itemName)
+	resp = makeRequest(t, "POST", apiURL+"/cart/items", token, []byte(payload))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Adding an item to the cart should return 200 OK")
+	resp = makeRequest(t, "PUT", apiURL+"/cart/items/"+itemName, token, []byte(`{"quantity": 2}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Updating a cart line should return 200 OK")
+	resp = makeRequest(t, "POST", apiURL+"/cart/items", token, []byte(`{"item": "invalid-item", "quantity": 1}`))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Adding an unknown item should return 400 Bad Request")
+
+	// Step 2: Nothing is charged until checkout
+	coins, _ := RequestUserInfo(t, token)
+	assert.Equal(t, amountconst, coins, "Adding to the cart should not charge coins")
+
+	// Step 3: A price change is reported in the cart and at checkout
+	resp = makeRequest(t, "PATCH", fmt.Sprintf("%s/admin/items/%d", apiURL, itemID), adminToken, []byte(`{"price": 15}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Updating an item should return 200 OK")
+
+	resp = makeRequest(t, "GET", apiURL+"/cart", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Listing the cart should return 200 OK")
+	var cart struct {
+		Total int `json:"total"`
+		Items []struct {
+			Item         string `json:"item"`
+			Quantity     int    `json:"quantity"`
+			PriceChanged bool   `json:"priceChanged"`
+		} `json:"items"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&cart)
+	assert.NoError(t, err, "Failed to decode cart response")
+	assert.Len(t, cart.Items, 2, "The cart should contain two lines")
+	assert.Equal(t, 20+2*15, cart.Total, "The cart should be priced at current prices")
+
+	resp = makeRequest(t, "POST", apiURL+"/cart/checkout", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Checking out the cart should return 200 OK")
+	var checkout struct {
+		Total        int `json:"total"`
+		PriceChanges []struct {
+			Item       string `json:"item"`
+			AddedPrice int    `json:"addedPrice"`
+			Price      int    `json:"price"`
+		} `json:"priceChanges"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&checkout)
+	assert.NoError(t, err, "Failed to decode checkout response")
+	assert.Equal(t, 50, checkout.Total, "The current prices should be charged")
+	if assert.Len(t, checkout.PriceChanges, 1, "The price change should be reported") {
+		assert.Equal(t, itemName, checkout.PriceChanges[0].Item)
+		assert.Equal(t, 10, checkout.PriceChanges[0].AddedPrice)
+		assert.Equal(t, 15, checkout.PriceChanges[0].Price)
+	}
+
+	coins, _ = RequestUserInfo(t, token)
+	assert.Equal(t, amountconst-50, coins, "The cart total should be debited")
+
+	// Step 4: The cart is empty after checkout
+	resp = makeRequest(t, "POST", apiURL+"/cart/checkout", token, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Checking out an empty cart should return 400 Bad Request")
+}
+
+// TestOrders tests that purchases are recorded as orders and their lifecycle.
+func TestOrders(t *testing.T) {
+	adminToken := authenticateUser(t, adminUsername, adminPassword)
+	username, password := Generate_Username_Password(1)
+	token := authenticateUser(t, username, password)
+
+	type order struct {
+		ID     int64  `json:"id"`
+		Status string `json:"status"`
+		Total  int    `json:"total"`
+	}
+	listOrders := func() []order {
+		resp := makeRequest(t, "GET", apiURL+"/orders", token, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Listing orders should return 200 OK")
+		var response struct {
+			Orders []order `json:"orders"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&response)
+		assert.NoError(t, err, "Failed to decode orders response")
+		return response.Orders
+	}
+	setStatus := func(id int64, status string) int {
+		payload := fmt.Sprintf(`{"status": "%s"}`, status)
+		resp := makeRequest(t, "PUT", fmt.Sprintf("%s/admin/orders/%d/status", apiURL, id), adminToken, []byte(payload))
+		return resp.StatusCode
+	}
+
+	// Step 1: A purchase places an order
+	resp := makeRequest(t, "GET", apiURL+"/buy/cup", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Buying an item should return 200 OK")
+	orders := listOrders()
+	if !assert.Len(t, orders, 1, "The purchase should be recorded as an order") {
+		return
+	}
+	assert.Equal(t, "placed", orders[0].Status)
+	assert.Equal(t, 20, orders[0].Total)
+
+	// Step 2: Employees cannot change the status
+	resp = makeRequest(t, "PUT", fmt.Sprintf("%s/admin/orders/%d/status", apiURL, orders[0].ID), token, []byte(`{"status": "picked"}`))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Changing the status as an employee should return 403 Forbidden")
+
+	// Step 3: Advance the order, shipped orders cannot be cancelled
+	assert.Equal(t, http.StatusOK, setStatus(orders[0].ID, "picked"))
+	assert.Equal(t, http.StatusOK, setStatus(orders[0].ID, "shipped"))
+	assert.Equal(t, http.StatusUnprocessableEntity, setStatus(orders[0].ID, "cancelled"), "Shipped orders cannot be cancelled")
+	assert.Equal(t, http.StatusOK, setStatus(orders[0].ID, "delivered"))
+
+	// Step 4: Cancelling an order refunds it
+	coins, _ := RequestUserInfo(t, token)
+	resp = makeRequest(t, "GET", apiURL+"/buy/pen", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Buying an item should return 200 OK")
+	orders = listOrders()
+	assert.Equal(t, http.StatusOK, setStatus(orders[0].ID, "cancelled"))
+
+	newCoins, inventory := RequestUserInfo(t, token)
+	assert.Equal(t, coins, newCoins, "A cancelled order should be refunded")
+	assert.Len(t, inventory, 1, "Cancelled units should leave the inventory")
+}
+
+// TestReturns tests returning purchased units for a refund.
+func TestReturns(t *testing.T) {
+	adminToken := authenticateUser(t, adminUsername, adminPassword)
+	username, password := Generate_Username_Password(1)
+	token := authenticateUser(t, username, password)
+	otherUsername, otherPassword := Generate_Username_Password(2)
+	otherToken := authenticateUser(t, otherUsername, otherPassword)
+
+	resp := makeRequest(t, "POST", apiURL+"/checkout", token, []byte(`{"items": [{"item": "pen", "quantity": 3}]}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Checkout should return 200 OK")
+	var receipt struct {
+		OrderID int64 `json:"orderId"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&receipt)
+	assert.NoError(t, err, "Failed to decode checkout response")
+	returnURL := fmt.Sprintf("%s/orders/%d/return", apiURL, receipt.OrderID)
+
+	// Step 1: Return two pens for the price paid
+	coins, _ := RequestUserInfo(t, token)
+	resp = makeRequest(t, "POST", returnURL, token, []byte(`{"item": "pen", "quantity": 2}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Returning units should return 200 OK")
+	newCoins, inventory := RequestUserInfo(t, token)
+	assert.Equal(t, coins+20, newCoins, "The price paid should be refunded")
+	if assert.Len(t, inventory, 1) {
+		assert.Equal(t, float64(1), inventory[0]["quantity"], "Returned units should leave the inventory")
+	}
+
+	// Step 2: Units cannot be returned twice, nor by someone else
+	resp = makeRequest(t, "POST", returnURL, token, []byte(`{"item": "pen", "quantity": 2}`))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Returning more units than left should return 400 Bad Request")
+	resp = makeRequest(t, "POST", returnURL, otherToken, []byte(`{"item": "pen", "quantity": 1}`))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Returning another user's order should return 404 Not Found")
+
+	// Step 3: An admin returns the last pen
+	adminURL := fmt.Sprintf("%s/admin/orders/%d/return", apiURL, receipt.OrderID)
+	resp = makeRequest(t, "POST", adminURL, adminToken, []byte(`{"item": "pen", "quantity": 1}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Returning units as an admin should return 200 OK")
+
+	// Step 4: The refunds are in the history
+	resp = makeRequest(t, "GET", apiURL+"/info", token, nil)
+	var info struct {
+		Coins       int `json:"coins"`
+		CoinHistory struct {
+			Refunds []struct {
+				Item     string `json:"item"`
+				Quantity int    `json:"quantity"`
+				Amount   int    `json:"amount"`
+			} `json:"refunds"`
+		} `json:"coinHistory"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	assert.NoError(t, err, "Failed to decode info response")
+	assert.Equal(t, amountconst, info.Coins, "Every pen should be refunded")
+	assert.Len(t, info.CoinHistory.Refunds, 2, "Both refunds should be in the history")
+}
+
 // TestInvalidBuyRequest tests buying an item with an invalid item name.
 func TestInvalidBuyRequest(t *testing.T) {
 	// Step 1: Authenticate a user